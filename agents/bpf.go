@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+
+	"postTap/probe"
+)
+
+// bpfTracer attaches the probes as uprobes with bpftrace, it needs neither
+// kernel debuginfo nor the stapdev group
+type bpfTracer struct{}
+
+func (t *bpfTracer) extension() string {
+	return ".bt"
+}
+
+// render writes the plan of the sampler into the script, bpftrace compiles
+// the script for every run anyway
+func (t *bpfTracer) render(script *probe.Script) string {
+	return probe.BPFTrace(script)
+}
+
+func (t *bpfTracer) params(script *probe.Script) map[string]string {
+	return nil
+}
+
+// command runs bpftrace quietly so it prints the probe lines only
+func (t *bpfTracer) command(scriptPath string, pid int, params map[string]string) *exec.Cmd {
+	arg := []string{"-q"}
+	if pid != 0 {
+		arg = append(arg, "-p", strconv.Itoa(pid))
+	}
+	return exec.Command("bpftrace", append(arg, scriptPath)...)
+}
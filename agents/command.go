@@ -1,60 +1,94 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os"
+	"path/filepath"
 	"postTap/common"
+	"postTap/communicator"
+	"postTap/probe"
+	"time"
 )
 
 type Command struct {
 	CommandName string
-	Script      []byte
+	Sampler     *probe.Sampler
 	Pid         int
-	RunningStp  map[int]*stap
+	Host        string
+	sessions    *supervisor
+	comm        communicator.Communicator
+	scriptDir   string
+	timeout     time.Duration
+	tracer      tracer
 }
 
-func (command *Command) SaveScript(stp *stap) {
-	if _, err := os.Stat(stp.scriptPath); os.IsNotExist(err) {
-		_, err = os.Create(stp.scriptPath)
-		if err != nil {
-			log.Printf("Error occurred during script opening: %s", err)
-			return
-		}
-	}
-	replaceall := bytes.Replace(command.Script, []byte("PLACEHOLDER_POSTGRES"), common.Which("postgres"), -1)
-	err := ioutil.WriteFile(stp.scriptPath, replaceall, 0644)
-	if err != nil {
-		log.Printf("Error occurred during script saving: %s", err)
-	}
+// SaveScript writes the sampler of the command in the language of the tracer
+func (command *Command) SaveScript(s *session) error {
+	script := &probe.Script{Binary: string(common.Which("postgres")), Sampler: command.Sampler}
+	s.params = command.tracer.params(script)
+	return ioutil.WriteFile(s.scriptPath, []byte(command.tracer.render(script)), 0644)
 }
 
 func (command *Command) Process(msg []byte) error {
+	// the processor is reused, do not keep fields of the previous command
+	command.CommandName, command.Sampler, command.Pid, command.Host = "", nil, 0, ""
 	err := json.Unmarshal(msg, command)
 	if err == nil {
+		if command.Host != "" && command.Host != agentHost {
+			log.Printf("Ignore command for host %s", command.Host)
+			return nil
+		}
 		switch command.CommandName {
-		case "RUN":
-			stp := command.GetStap()
-			if len(command.Script) > 0 {
-				command.SaveScript(stp)
+		case "START", "RUN":
+			// a session of the pid, started or about to start, belongs to an
+			// earlier query of the backend, the new script replaces it
+			if _, ok := command.sessions.Get(command.Pid); ok {
+				if command.Sampler == nil {
+					log.Printf("session for pid %d is already running", command.Pid)
+					return nil
+				}
+				command.sessions.Stop(command.Pid)
+			}
+			s := command.GetSession()
+			if command.Sampler != nil {
+				if err := command.SaveScript(s); err != nil {
+					log.Printf("Error occurred during script saving: %s", err)
+					return nil
+				}
+			}
+			if err := command.sessions.Start(s); err != nil {
+				log.Println(err)
 			}
-			stp.Run()
-			/*	case "STOP":
-				stp := command.GetStap()
-				stp.Stop()
-				delete(command.RunningStp, command.Pid)*/
+		case "STOP":
+			command.sessions.Stop(command.Pid)
+			return command.Acknowledge()
 		}
 	}
 	return err
 }
-func (command *Command) GetStap() *stap {
-	if stp, ok := command.RunningStp[command.Pid]; ok {
-		return stp
+
+// Acknowledge tells shield the stap session of the pid has been stopped
+func (command *Command) Acknowledge() error {
+	if command.comm == nil {
+		return nil
+	}
+	ack, err := communicator.NewProbeMsg(agentHost, command.Pid, "StopAck", nil).Encode()
+	if err != nil {
+		return err
+	}
+	return command.comm.Send("probe", ack)
+}
+
+// GetSession returns a new session of the pid, the supervisor keeps it once
+// it is started. A sampling session ends with its query, the timeout only
+// applies to the other scripts.
+func (command *Command) GetSession() *session {
+	scriptPath := filepath.Join(command.scriptDir, fmt.Sprintf("%d%s", command.Pid, command.tracer.extension()))
+	timeout := command.timeout
+	if command.Sampler != nil {
+		timeout = 0
 	}
-	stp := &stap{scriptPath: fmt.Sprintf("/tmp/%d.stp", command.Pid), pid: command.Pid, timeout: 10}
-	command.RunningStp[command.Pid] = stp
-	return stp
+	return &session{scriptPath: scriptPath, pid: command.Pid, timeout: timeout, comm: command.comm, tracer: command.tracer}
 }
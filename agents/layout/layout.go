@@ -0,0 +1,347 @@
+// Package layout derives the struct offsets and NodeTag values the probes
+// need from the DWARF debug info of the postgres binary, so servers built with
+// unusual flags or patches do not need a hand written profile.
+package layout
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"postTap/pgprofile"
+)
+
+// ProfileName is the name of profiles built from debug info
+const ProfileName = "dwarf"
+
+// DebugDir is where distributions install separate debug info
+var DebugDir = "/usr/lib/debug"
+
+type member struct {
+	structName string
+	name       string
+	set        func(l *pgprofile.Layout, offset int)
+}
+
+// members are the struct members the probes read
+var members = []member{
+	{"QueryDesc", "planstate", func(l *pgprofile.Layout, o int) { l.QueryDescPlanState = o }},
+	{"PlanState", "plan", func(l *pgprofile.Layout, o int) { l.PlanStatePlan = o }},
+	{"PlanState", "instrument", func(l *pgprofile.Layout, o int) { l.PlanStateInstrument = o }},
+	{"PlanState", "lefttree", func(l *pgprofile.Layout, o int) { l.PlanStateLeftTree = o }},
+	{"PlanState", "righttree", func(l *pgprofile.Layout, o int) { l.PlanStateRightTree = o }},
+	{"Plan", "startup_cost", func(l *pgprofile.Layout, o int) { l.PlanStartupCost = o }},
+	{"Plan", "total_cost", func(l *pgprofile.Layout, o int) { l.PlanTotalCost = o }},
+	{"Plan", "plan_rows", func(l *pgprofile.Layout, o int) { l.PlanRows = o }},
+	{"Plan", "plan_width", func(l *pgprofile.Layout, o int) { l.PlanWidth = o }},
+	{"Plan", "plan_node_id", func(l *pgprofile.Layout, o int) { l.PlanNodeID = o }},
+	{"Instrumentation", "running", func(l *pgprofile.Layout, o int) { l.InstrRunning = o }},
+	{"Instrumentation", "tuplecount", func(l *pgprofile.Layout, o int) { l.InstrTupleCount = o }},
+	{"Instrumentation", "startup", func(l *pgprofile.Layout, o int) { l.InstrStartup = o }},
+	{"Instrumentation", "total", func(l *pgprofile.Layout, o int) { l.InstrTotal = o }},
+	{"Instrumentation", "ntuples", func(l *pgprofile.Layout, o int) { l.InstrNTuples = o }},
+	{"Instrumentation", "nloops", func(l *pgprofile.Layout, o int) { l.InstrNLoops = o }},
+	{"Instrumentation", "bufusage", func(l *pgprofile.Layout, o int) { l.InstrBufUsage = o }},
+	{"PlanState", "initPlan", func(l *pgprofile.Layout, o int) { l.PlanStateInitPlan = o }},
+	{"PlanState", "subPlan", func(l *pgprofile.Layout, o int) { l.PlanStateSubPlan = o }},
+	{"SubPlanState", "planstate", func(l *pgprofile.Layout, o int) { l.SubPlanStatePlanState = o }},
+	{"List", "length", func(l *pgprofile.Layout, o int) { l.ListLength = o }},
+}
+
+// optionalMembers leave their offset 0 when missing, the probes do not follow
+// the nodes they belong to then. List is linked up to PG12 and an array since
+// PG13, listForms checks one of them was found.
+var optionalMembers = []member{
+	{"List", "head", func(l *pgprofile.Layout, o int) { l.ListHead = o }},
+	{"ListCell", "next", func(l *pgprofile.Layout, o int) { l.ListCellNext = o }},
+	{"List", "elements", func(l *pgprofile.Layout, o int) { l.ListElements = o }},
+	{"AppendState", "appendplans", func(l *pgprofile.Layout, o int) { l.AppendPlans = o }},
+	{"AppendState", "as_nplans", func(l *pgprofile.Layout, o int) { l.AppendNPlans = o }},
+	{"MergeAppendState", "mergeplans", func(l *pgprofile.Layout, o int) { l.MergeAppendPlans = o }},
+	{"MergeAppendState", "ms_nplans", func(l *pgprofile.Layout, o int) { l.MergeAppendNPlans = o }},
+	{"BitmapAndState", "bitmapplans", func(l *pgprofile.Layout, o int) { l.BitmapAndPlans = o }},
+	{"BitmapAndState", "nplans", func(l *pgprofile.Layout, o int) { l.BitmapAndNPlans = o }},
+	{"BitmapOrState", "bitmapplans", func(l *pgprofile.Layout, o int) { l.BitmapOrPlans = o }},
+	{"BitmapOrState", "nplans", func(l *pgprofile.Layout, o int) { l.BitmapOrNPlans = o }},
+	{"SubqueryScanState", "subplan", func(l *pgprofile.Layout, o int) { l.SubqueryScanSubplan = o }},
+	{"Plan", "parallel_aware", func(l *pgprofile.Layout, o int) { l.PlanParallelAware = o }},
+	{"Plan", "async_capable", func(l *pgprofile.Layout, o int) { l.PlanAsyncCapable = o }},
+	{"SubPlanState", "subplan", func(l *pgprofile.Layout, o int) { l.SubPlanStateSubPlan = o }},
+	{"SubPlan", "setParam", func(l *pgprofile.Layout, o int) { l.SubPlanSetParam = o }},
+	{"Gather", "num_workers", func(l *pgprofile.Layout, o int) { l.GatherNumWorkers = o }},
+}
+
+// leaderVars are the globals holding the leader pid of a parallel worker,
+// PG14 renamed ParallelMasterPid
+var leaderVars = map[string]bool{"ParallelLeaderPid": true, "ParallelMasterPid": true}
+
+// procNodeFunctions are the functions the sampler probes, ExecProcNodeInstr
+// where ExecProcNode is inline
+var procNodeFunctions = map[string]bool{pgprofile.DefaultProcNodeFunction: true, "ExecProcNode": true}
+
+// The T_*State values run from T_PlanState to T_LimitState, PG16 made
+// PlanState abstract so they start at T_ResultState there
+const (
+	firstStateTag    = "T_PlanState"
+	firstStateTagV16 = "T_ResultState"
+	lastStateTag     = "T_LimitState"
+)
+
+// FromBinary builds a profile from the debug info of the binary at path,
+// looking for separate debug info when the binary is stripped
+func FromBinary(path string) (*pgprofile.Profile, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Section(".debug_info") == nil {
+		debugPath, err := findDebugFile(f, path)
+		if err != nil {
+			return nil, err
+		}
+		df, err := elf.Open(debugPath)
+		if err != nil {
+			return nil, err
+		}
+		defer df.Close()
+		f = df
+	}
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read debug info of %s: %s", path, err)
+	}
+	return FromDWARF(d)
+}
+
+// findDebugFile locates the separate debug info of a stripped binary by its
+// build id or its .gnu_debuglink
+func findDebugFile(f *elf.File, path string) (string, error) {
+	candidates := []string{}
+	if id := buildID(f); len(id) > 1 {
+		hexID := hex.EncodeToString(id)
+		candidates = append(candidates, filepath.Join(DebugDir, ".build-id", hexID[:2], hexID[2:]+".debug"))
+	}
+	if link := debugLink(f); link != "" {
+		dir := filepath.Dir(path)
+		candidates = append(candidates,
+			filepath.Join(dir, link),
+			filepath.Join(dir, ".debug", link),
+			filepath.Join(DebugDir, dir, link))
+	}
+	candidates = append(candidates, filepath.Join(DebugDir, path+".debug"))
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no debug info, install its debug symbols (tried %s)", path, strings.Join(candidates, ", "))
+}
+
+// buildID returns the GNU build id note of the binary
+func buildID(f *elf.File) []byte {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return nil
+	}
+	data, err := s.Data()
+	// namesz, descsz, type, then the "GNU\0" name and the id
+	if err != nil || len(data) < 16 {
+		return nil
+	}
+	namesz := f.ByteOrder.Uint32(data[0:4])
+	descsz := f.ByteOrder.Uint32(data[4:8])
+	start := 12 + (namesz+3)&^3
+	if uint32(len(data)) < start+descsz {
+		return nil
+	}
+	return data[start : start+descsz]
+}
+
+// debugLink returns the file name recorded in .gnu_debuglink
+func debugLink(f *elf.File) string {
+	s := f.Section(".gnu_debuglink")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil {
+		return ""
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+// FromDWARF builds a profile from debug info, it fails naming every struct,
+// member or enum value it could not find
+func FromDWARF(d *dwarf.Data) (*pgprofile.Profile, error) {
+	structs, tags, globals, err := collect(d)
+	if err != nil {
+		return nil, err
+	}
+	p := &pgprofile.Profile{Name: ProfileName, ParallelLeaderVar: globals.leaderVar, ProcNodeFunction: globals.procNode}
+	missing := []string{}
+	for _, m := range members {
+		st, ok := structs[m.structName]
+		if !ok {
+			missing = append(missing, "struct "+m.structName)
+			continue
+		}
+		offset, ok := fieldOffset(st, m.name)
+		if !ok {
+			missing = append(missing, m.structName+"."+m.name)
+			continue
+		}
+		m.set(&p.Layout, offset)
+	}
+	for _, m := range optionalMembers {
+		if offset, ok := fieldOffset(structs[m.structName], m.name); ok {
+			m.set(&p.Layout, offset)
+		}
+	}
+	if globals.procNode == "" {
+		missing = append(missing, "function "+pgprofile.DefaultProcNodeFunction+" or ExecProcNode")
+	}
+	missing = append(missing, listForms(&p.Layout)...)
+	if tags == nil {
+		missing = append(missing, "enum NodeTag")
+	} else if err := setStateTags(p, tags); err != nil {
+		missing = append(missing, err.Error())
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Debug info lacks %s", strings.Join(dedup(missing), ", "))
+	}
+	return p, nil
+}
+
+// globals are the variables and functions of the binary the probes use
+type globals struct {
+	leaderVar string
+	procNode  string
+}
+
+// collect finds the complete definitions of the wanted structs, the NodeTag
+// enum, the parallel leader pid variable and the function the sampler probes
+func collect(d *dwarf.Data) (map[string]*dwarf.StructType, *dwarf.EnumType, globals, error) {
+	wanted := map[string]bool{}
+	for _, m := range append(members, optionalMembers...) {
+		wanted[m.structName] = true
+	}
+	structs := map[string]*dwarf.StructType{}
+	var tags *dwarf.EnumType
+	found := globals{}
+	r := d.Reader()
+	for len(structs) < len(wanted) || tags == nil || found.leaderVar == "" || found.procNode != pgprofile.DefaultProcNodeFunction {
+		e, err := r.Next()
+		if err != nil {
+			return nil, nil, found, err
+		}
+		if e == nil {
+			break
+		}
+		name, _ := e.Val(dwarf.AttrName).(string)
+		declaration, _ := e.Val(dwarf.AttrDeclaration).(bool)
+		switch {
+		case e.Tag == dwarf.TagStructType && wanted[name] && structs[name] == nil && !declaration:
+			t, err := d.Type(e.Offset)
+			if err != nil {
+				return nil, nil, found, err
+			}
+			if st, ok := t.(*dwarf.StructType); ok && !st.Incomplete {
+				structs[name] = st
+			}
+		case e.Tag == dwarf.TagEnumerationType && name == "NodeTag" && tags == nil && !declaration:
+			t, err := d.Type(e.Offset)
+			if err != nil {
+				return nil, nil, found, err
+			}
+			tags, _ = t.(*dwarf.EnumType)
+		case e.Tag == dwarf.TagVariable && leaderVars[name]:
+			found.leaderVar = name
+		case e.Tag == dwarf.TagSubprogram && procNodeFunctions[name] && found.procNode != pgprofile.DefaultProcNodeFunction:
+			// an inline ExecProcNode has no code of its own to probe
+			if _, inline := e.Val(dwarf.AttrInline).(int64); !inline && e.Val(dwarf.AttrLowpc) != nil {
+				found.procNode = name
+			}
+		}
+		// only the top level of a compile unit holds the definitions
+		if e.Children && e.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+		}
+	}
+	return structs, tags, found, nil
+}
+
+// listForms returns what is missing to walk a List, a linked list needs
+// List.head and ListCell.next, an array List.elements
+func listForms(l *pgprofile.Layout) []string {
+	switch {
+	case l.ListElements != 0:
+		return nil
+	case l.ListHead != 0 && l.ListCellNext != 0:
+		return nil
+	case l.ListHead != 0:
+		return []string{"ListCell.next"}
+	}
+	return []string{"List.head or List.elements"}
+}
+
+func fieldOffset(st *dwarf.StructType, name string) (int, bool) {
+	if st == nil {
+		return 0, false
+	}
+	for _, field := range st.Field {
+		if field.Name == name {
+			return int(field.ByteOffset), true
+		}
+	}
+	return 0, false
+}
+
+// setStateTags fills the T_*State names in enum order, values without a
+// name are left empty
+func setStateTags(p *pgprofile.Profile, tags *dwarf.EnumType) error {
+	values := map[string]int64{}
+	for _, v := range tags.Val {
+		values[v.Name] = v.Val
+	}
+	first, ok := values[firstStateTag]
+	if !ok {
+		if first, ok = values[firstStateTagV16]; !ok {
+			return fmt.Errorf("NodeTag.%s", firstStateTag)
+		}
+	}
+	last, ok := values[lastStateTag]
+	if !ok || last < first {
+		return fmt.Errorf("NodeTag.%s", lastStateTag)
+	}
+	p.FirstPlanStateTag = int(first)
+	p.PlanStateTags = make([]string, last-first+1)
+	for name, v := range values {
+		if v >= first && v <= last && strings.HasPrefix(name, "T_") {
+			p.PlanStateTags[v-first] = strings.TrimPrefix(name, "T_")
+		}
+	}
+	return nil
+}
+
+func dedup(names []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,103 @@
+package layout
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"postTap/pgprofile"
+)
+
+// compileFixture builds testdata/fixture.c with debug info
+func compileFixture(t *testing.T, defines ...string) string {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	obj := filepath.Join(t.TempDir(), "fixture.o")
+	args := append([]string{"-g", "-c", "-o", obj}, defines...)
+	args = append(args, filepath.Join("testdata", "fixture.c"))
+	if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to compile fixture: %s\n%s", err, out)
+	}
+	return obj
+}
+
+func TestFromBinary(t *testing.T) {
+	p, err := FromBinary(compileFixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != ProfileName {
+		t.Errorf("name %s", p.Name)
+	}
+	// the fixture copies the PG11 structs
+	pg11, _ := pgprofile.GetProfile("pg11")
+	if p.Layout != pg11.Layout {
+		t.Errorf("layout %+v, expected %+v", p.Layout, pg11.Layout)
+	}
+	if p.ParallelLeaderVar != "ParallelMasterPid" {
+		t.Errorf("parallel leader variable %q", p.ParallelLeaderVar)
+	}
+	if p.ProcNodeFunction != "ExecProcNodeInstr" {
+		t.Errorf("sampled function %q", p.ProcNodeFunction)
+	}
+	if p.FirstPlanStateTag != 7 {
+		t.Errorf("first planstate tag %d", p.FirstPlanStateTag)
+	}
+	expected := []string{"PlanState", "ResultState", "SeqScanState", "", "LimitState"}
+	if !reflect.DeepEqual(p.PlanStateTags, expected) {
+		t.Errorf("planstate tags %v", p.PlanStateTags)
+	}
+	if p.NodeTypeString(9) != "Seq Scan" {
+		t.Errorf("node type %q", p.NodeTypeString(9))
+	}
+}
+
+func TestMissingMember(t *testing.T) {
+	_, err := FromBinary(compileFixture(t, "-DBROKEN"))
+	if err == nil || !strings.Contains(err.Error(), "Instrumentation.nloops") {
+		t.Fatalf("expected missing member error, got %v", err)
+	}
+}
+
+func TestArrayList(t *testing.T) {
+	p, err := FromBinary(compileFixture(t, "-DARRAY_LIST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ListLength != 4 || p.ListElements != 16 || p.ListHead != 0 || p.ListCellNext != 0 {
+		t.Errorf("list layout %+v", p.Layout)
+	}
+	if p.AppendPlans != 144 || p.SubqueryScanSubplan != 168 {
+		t.Errorf("child layout %+v", p.Layout)
+	}
+}
+
+func TestOldExecutor(t *testing.T) {
+	p, err := FromBinary(compileFixture(t, "-DOLD_EXECUTOR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ProcNodeFunction != "ExecProcNode" {
+		t.Errorf("sampled function %q", p.ProcNodeFunction)
+	}
+}
+
+func TestNoDebugInfo(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	obj := filepath.Join(t.TempDir(), "fixture.o")
+	if out, err := exec.Command(cc, "-c", "-o", obj, filepath.Join("testdata", "fixture.c")).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to compile fixture: %s\n%s", err, out)
+	}
+	defer func(dir string) { DebugDir = dir }(DebugDir)
+	DebugDir = t.TempDir()
+	if _, err := FromBinary(obj); err == nil || !strings.Contains(err.Error(), "no debug info") {
+		t.Fatalf("expected no debug info error, got %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ * Cut down copies of the PostgreSQL 11 executor structs, compiled with -g by
+ * the layout tests to get DWARF with known offsets. Defining BROKEN drops a
+ * member the probes need, ARRAY_LIST uses the List of PostgreSQL 13 and
+ * OLD_EXECUTOR calls ExecProcNode like servers before PostgreSQL 10.
+ */
+#include <stdbool.h>
+
+typedef enum NodeTag
+{
+	T_Invalid = 0,
+	T_IndexInfo,
+	T_ExprContext,
+	T_Plan,
+	T_Result,
+	T_SeqScan,
+	T_Limit,
+	T_PlanState,
+	T_ResultState,
+	T_SeqScanState,
+	/* leaves a value without a name */
+	T_LimitState = T_SeqScanState + 2,
+	T_Query
+} NodeTag;
+
+typedef double Cost;
+
+typedef struct instr_time
+{
+	long		tv_sec;
+	long		tv_nsec;
+} instr_time;
+
+typedef struct BufferUsage
+{
+	long		shared_blks_hit;
+	long		shared_blks_read;
+	long		shared_blks_dirtied;
+	long		shared_blks_written;
+	long		local_blks_hit;
+	long		local_blks_read;
+	long		local_blks_dirtied;
+	long		local_blks_written;
+	long		temp_blks_read;
+	long		temp_blks_written;
+	instr_time	blk_read_time;
+	instr_time	blk_write_time;
+} BufferUsage;
+
+typedef struct Instrumentation
+{
+	bool		need_timer;
+	bool		need_bufusage;
+	bool		running;
+	instr_time	starttime;
+	instr_time	counter;
+	double		firsttuple;
+	double		tuplecount;
+	BufferUsage bufusage_start;
+	double		startup;
+	double		total;
+	double		ntuples;
+#ifndef BROKEN
+	double		nloops;
+#endif
+	double		nfiltered1;
+	double		nfiltered2;
+	BufferUsage bufusage;
+} Instrumentation;
+
+typedef struct Plan
+{
+	NodeTag		type;
+	Cost		startup_cost;
+	Cost		total_cost;
+	double		plan_rows;
+	int			plan_width;
+	bool		parallel_aware;
+	bool		parallel_safe;
+	int			plan_node_id;
+	struct List *targetlist;
+	struct List *qual;
+	struct Plan *lefttree;
+	struct Plan *righttree;
+	struct List *initPlan;
+	void	   *extParam;
+	void	   *allParam;
+} Plan;
+
+typedef struct Gather
+{
+	Plan		plan;
+	int			num_workers;
+	int			rescan_param;
+	bool		single_copy;
+	bool		invisible;
+	void	   *initParam;
+} Gather;
+
+typedef struct PlanState
+{
+	NodeTag		type;
+	Plan	   *plan;
+	struct EState *state;
+	void	   *ExecProcNode;
+	void	   *ExecProcNodeReal;
+	Instrumentation *instrument;
+	void	   *worker_instrument;
+	void	   *worker_jit_instrument;
+	void	   *qual;
+	struct PlanState *lefttree;
+	struct PlanState *righttree;
+	struct List *initPlan;
+	struct List *subPlan;
+	void	   *chgParam;
+	void	   *ps_ResultTupleSlot;
+	void	   *ps_ExprContext;
+	void	   *ps_ProjInfo;
+	void	   *scandesc;
+} PlanState;
+
+#ifndef ARRAY_LIST
+typedef struct ListCell
+{
+	union
+	{
+		void	   *ptr_value;
+		int			int_value;
+	}			data;
+	struct ListCell *next;
+} ListCell;
+
+typedef struct List
+{
+	NodeTag		type;
+	int			length;
+	ListCell   *head;
+	ListCell   *tail;
+} List;
+#else
+typedef union ListCell
+{
+	void	   *ptr_value;
+	int			int_value;
+} ListCell;
+
+typedef struct List
+{
+	NodeTag		type;
+	int			length;
+	int			max_length;
+	ListCell   *elements;
+	ListCell	initial_elements[];
+} List;
+#endif
+
+typedef struct SubPlanState
+{
+	NodeTag		type;
+	struct SubPlan *subplan;
+	PlanState  *planstate;
+} SubPlanState;
+
+typedef struct SubPlan
+{
+	NodeTag		type;
+	int			subLinkType;
+	void	   *testexpr;
+	struct List *paramIds;
+	int			plan_id;
+	char	   *plan_name;
+	unsigned int firstColType;
+	int			firstColTypmod;
+	unsigned int firstColCollation;
+	bool		useHashTable;
+	bool		unknownEqFalse;
+	bool		parallel_safe;
+	struct List *setParam;
+	struct List *parParam;
+	struct List *args;
+} SubPlan;
+
+typedef struct ScanState
+{
+	PlanState	ps;
+	void	   *ss_currentRelation;
+	void	   *ss_currentScanDesc;
+	void	   *ss_ScanTupleSlot;
+} ScanState;
+
+typedef struct AppendState
+{
+	PlanState	ps;
+	PlanState **appendplans;
+	int			as_nplans;
+} AppendState;
+
+typedef struct MergeAppendState
+{
+	PlanState	ps;
+	PlanState **mergeplans;
+	int			ms_nplans;
+} MergeAppendState;
+
+typedef struct BitmapAndState
+{
+	PlanState	ps;
+	PlanState **bitmapplans;
+	int			nplans;
+} BitmapAndState;
+
+typedef struct BitmapOrState
+{
+	PlanState	ps;
+	PlanState **bitmapplans;
+	int			nplans;
+} BitmapOrState;
+
+typedef struct SubqueryScanState
+{
+	ScanState	ss;
+	PlanState  *subplan;
+} SubqueryScanState;
+
+typedef struct QueryDesc
+{
+	int			operation;
+	void	   *plannedstmt;
+	const char *sourceText;
+	void	   *snapshot;
+	void	   *crosscheck_snapshot;
+	void	   *dest;
+	void	   *params;
+	void	   *queryEnv;
+	int			instrument_options;
+	void	   *tupDesc;
+	struct EState *estate;
+	PlanState  *planstate;
+} QueryDesc;
+
+int			ParallelMasterPid;
+QueryDesc	fixture_desc;
+NodeTag		fixture_tag;
+List		fixture_list;
+SubPlanState fixture_subplan;
+SubPlan		fixture_subplan_expr;
+AppendState fixture_append;
+MergeAppendState fixture_merge_append;
+BitmapAndState fixture_bitmap_and;
+BitmapOrState fixture_bitmap_or;
+SubqueryScanState fixture_subquery_scan;
+Gather		fixture_gather;
+
+#ifndef OLD_EXECUTOR
+static inline void *
+ExecProcNode(PlanState *node)
+{
+	return node->ExecProcNode;
+}
+
+static void *
+ExecProcNodeInstr(PlanState *node)
+{
+	return node->ExecProcNodeReal;
+}
+
+void *
+fixture_exec(PlanState *node)
+{
+	return ExecProcNodeInstr(node) ? ExecProcNode(node) : 0;
+}
+#else
+void *
+ExecProcNode(PlanState *node)
+{
+	return node->plan;
+}
+#endif
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveProfile(t *testing.T) {
+	p, err := resolveProfile("pg12", "/nonexistent/postgres")
+	if err != nil || p.Name != "pg12" {
+		t.Fatalf("expected the built-in profile, got %v %v", p, err)
+	}
+	if _, err := resolveProfile("gp6", "/nonexistent/postgres"); err == nil || !strings.Contains(err.Error(), "gp6") {
+		t.Errorf("expected an error naming gp6, got %v", err)
+	}
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	obj := filepath.Join(t.TempDir(), "fixture.o")
+	if out, err := exec.Command(cc, "-g", "-c", "-o", obj, filepath.Join("layout", "testdata", "fixture.c")).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to compile fixture: %s\n%s", err, out)
+	}
+	// Greenplum and the tags of PG16 come from the debug info
+	for _, name := range []string{"gp6", "gp7", "pg16"} {
+		p, err := resolveProfile(name, obj)
+		if err != nil || p.Name != "dwarf" {
+			t.Errorf("%s: expected the dwarf profile, got %v %v", name, p, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"postTap/probe"
+)
+
+// stapOptions are passed to every stap compile. The sampling session gets
+// the plan as a string of node addresses, the default 128 bytes hold only a
+// few nodes.
+var stapOptions = []string{"-w", fmt.Sprintf("-DMAXSTRINGLEN=%d", probe.MaxStringLen)}
+
+// moduleCache keeps the kernel modules stap compiled, keyed by the hash of
+// the script, so a script is compiled once and every later session only
+// loads the module with staprun. The least recently used modules are evicted
+// beyond maxEntries.
+type moduleCache struct {
+	dir        string
+	maxEntries int
+	// compile builds the module name.ko of the script into dir
+	compile func(script string, dir string, name string) error
+	lock    sync.Mutex
+	// building holds the compiles in progress, sessions of the same script
+	// wait for the first one
+	building map[string]*moduleBuild
+	stats    moduleCacheStats
+}
+
+type moduleBuild struct {
+	done chan struct{}
+	err  error
+}
+
+// moduleCacheStats are the counters published under stap_module_cache
+type moduleCacheStats struct {
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	CompileErrors  int64   `json:"compile_errors"`
+	Evictions      int64   `json:"evictions"`
+	Entries        int     `json:"entries"`
+	CompileSeconds float64 `json:"compile_seconds"`
+}
+
+func newModuleCache(dir string, maxEntries int) (*moduleCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	cache := &moduleCache{dir: dir, maxEntries: maxEntries, compile: stapCompile, building: map[string]*moduleBuild{}}
+	cache.stats.Entries = len(cache.entries())
+	return cache, nil
+}
+
+// stapCompile runs the first four passes of stap, the module is written to
+// the working directory
+func stapCompile(script string, dir string, name string) error {
+	args := append(append([]string{}, stapOptions...), "-p4", "-m", name, script)
+	cmd := exec.Command("stap", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// moduleName derives the module name from the script and the kernel the
+// module is built for, stap module names only take letters, digits and _
+func moduleName(script []byte) string {
+	h := sha256.New()
+	h.Write(script)
+	h.Write([]byte(kernelRelease()))
+	// modules built with other options are not reused
+	h.Write([]byte(strings.Join(stapOptions, " ")))
+	return "posttap_" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func kernelRelease() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return ""
+	}
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return string(release)
+}
+
+// Module returns the path of the compiled module of the script file,
+// compiling it on a miss
+func (c *moduleCache) Module(scriptPath string) (string, error) {
+	script, err := ioutil.ReadFile(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	name := moduleName(script)
+	path := filepath.Join(c.dir, name+".ko")
+
+	c.lock.Lock()
+	if build, ok := c.building[name]; ok {
+		c.lock.Unlock()
+		<-build.done
+		return path, build.err
+	}
+	if _, err := os.Stat(path); err == nil {
+		c.stats.Hits++
+		c.lock.Unlock()
+		// the modification time orders the modules for eviction
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, nil
+	}
+	c.stats.Misses++
+	build := &moduleBuild{done: make(chan struct{})}
+	c.building[name] = build
+	c.lock.Unlock()
+
+	start := time.Now()
+	build.err = c.build(scriptPath, name)
+	elapsed := time.Since(start)
+
+	c.lock.Lock()
+	delete(c.building, name)
+	c.stats.CompileSeconds += elapsed.Seconds()
+	if build.err != nil {
+		c.stats.CompileErrors++
+	}
+	c.lock.Unlock()
+	close(build.done)
+	if build.err != nil {
+		return "", build.err
+	}
+	log.Printf("Compiled stap module %s in %s", name, elapsed)
+	c.evict()
+	return path, nil
+}
+
+// build compiles into a private directory and moves the module into the
+// cache, a module in the cache is always complete
+func (c *moduleCache) build(scriptPath string, name string) error {
+	tmp, err := ioutil.TempDir(c.dir, "build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	abs, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return err
+	}
+	if err := c.compile(abs, tmp, name); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(tmp, name+".ko"), filepath.Join(c.dir, name+".ko"))
+}
+
+// entries returns the modules of the cache, least recently used first
+func (c *moduleCache) entries() []os.FileInfo {
+	files, _ := ioutil.ReadDir(c.dir)
+	modules := []os.FileInfo{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".ko") {
+			modules = append(modules, f)
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i].ModTime().Before(modules[j].ModTime()) })
+	return modules
+}
+
+// evict removes the least recently used modules beyond maxEntries. staprun
+// has read a running module already, removing its file does not harm it.
+func (c *moduleCache) evict() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	modules := c.entries()
+	if c.maxEntries > 0 {
+		for len(modules) > c.maxEntries {
+			if err := os.Remove(filepath.Join(c.dir, modules[0].Name())); err != nil {
+				log.Printf("Failed to evict stap module: %s", err)
+				break
+			}
+			log.Printf("Evicted stap module %s", modules[0].Name())
+			c.stats.Evictions++
+			modules = modules[1:]
+		}
+	}
+	c.stats.Entries = len(modules)
+}
+
+// Stats returns a copy of the counters
+func (c *moduleCache) Stats() moduleCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// publish exports the counters with expvar, served on /debug/vars
+func (c *moduleCache) publish() {
+	expvar.Publish("stap_module_cache", expvar.Func(func() interface{} { return c.Stats() }))
+}
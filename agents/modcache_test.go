@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCompile writes the script as module and counts the compiles
+type fakeCompile struct {
+	lock  sync.Mutex
+	count int
+}
+
+func (f *fakeCompile) compile(script string, dir string, name string) error {
+	f.lock.Lock()
+	f.count++
+	f.lock.Unlock()
+	data, err := ioutil.ReadFile(script)
+	if err != nil {
+		return err
+	}
+	// keep concurrent sessions waiting for the compile
+	time.Sleep(10 * time.Millisecond)
+	return ioutil.WriteFile(filepath.Join(dir, name+".ko"), data, 0644)
+}
+
+func TestModuleCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posttap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := newModuleCache(filepath.Join(dir, "modules"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeCompile{}
+	cache.compile = fake.compile
+	script := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// sessions of the same script share one compile
+	first := script("1.stp", "probe begin {}")
+	second := script("2.stp", "probe begin {}")
+	var wg sync.WaitGroup
+	paths := make([]string, 4)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := first
+			if i%2 == 1 {
+				path = second
+			}
+			var err error
+			if paths[i], err = cache.Module(path); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if fake.count != 1 {
+		t.Errorf("compiled %d times", fake.count)
+	}
+	for _, path := range paths {
+		if path != paths[0] {
+			t.Fatalf("different modules of the same script %v", paths)
+		}
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the least recently used module goes first
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(paths[0], old, old)
+	other, _ := cache.Module(script("3.stp", "probe end {}"))
+	if _, err := cache.Module(first); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(other, old, old)
+	if _, err := cache.Module(script("4.stp", "probe timer.s(1) {}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Error("least recently used module kept")
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Error("recently used module evicted")
+	}
+	stats := cache.Stats()
+	if stats.Misses != 3 || stats.Hits < 1 || stats.Evictions != 1 || stats.Entries != 2 || fake.count != 3 {
+		t.Errorf("unexpected stats %+v after %d compiles", stats, fake.count)
+	}
+}
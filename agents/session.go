@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"postTap/communicator"
+	"postTap/probe"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// states of a session
+const (
+	sessionIdle    = "idle"
+	sessionRunning = "running"
+	// exited on its own with status 0
+	sessionExited = "exited"
+	// failed to start or exited with an error
+	sessionFailed = "failed"
+	// stopped by a STOP command or the shutdown of the agent
+	sessionStopped = "stopped"
+	// killed after running longer than the timeout
+	sessionTimeout = "timeout"
+)
+
+// stderrTailLines is the number of stderr lines a session keeps
+const stderrTailLines = 20
+
+// killGrace is how long Stop waits for the tracer to exit after SIGTERM
+// before it sends SIGKILL, stap unloads its module on SIGTERM
+var killGrace = 5 * time.Second
+
+// session runs one tracer process and sends the probes it prints to shield
+type session struct {
+	scriptPath string
+	pid        int
+	// timeout stops the tracer after it ran that long, 0 never does
+	timeout  time.Duration
+	cmd      *exec.Cmd
+	state    string
+	exitCode int
+	stderr   []string
+	started  time.Time
+	// done is closed when the running tracer exited
+	done     chan struct{}
+	stopping bool
+	expired  bool
+	// claimed is set by the supervisor running the session, it runs once
+	claimed bool
+	lock    sync.Mutex
+	comm    communicator.Communicator
+	// params are the module parameters of the script
+	params map[string]string
+	tracer tracer
+}
+
+// sessionStatus is what the agent publishes of a session under
+// tracer_sessions
+type sessionStatus struct {
+	Script   string    `json:"script"`
+	Pid      int       `json:"pid"`
+	State    string    `json:"state"`
+	ExitCode int       `json:"exit_code"`
+	Started  time.Time `json:"started"`
+	Stderr   []string  `json:"stderr"`
+}
+
+// Run starts the tracer and waits for it to exit. It returns the error the
+// tracer failed with, nil when it exited with status 0 or was stopped.
+func (s *session) Run() error {
+	cmd := s.tracer.command(s.scriptPath, s.pid, s.params)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	s.lock.Lock()
+	if s.stopping {
+		// stopped before it started
+		s.state = sessionStopped
+		s.stopping = false
+		s.lock.Unlock()
+		return nil
+	}
+	cmdStdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.lock.Unlock()
+		return s.fail(err)
+	}
+	cmdErr, err := cmd.StderrPipe()
+	if err != nil {
+		s.lock.Unlock()
+		return s.fail(err)
+	}
+	if err := cmd.Start(); err != nil {
+		s.lock.Unlock()
+		return s.fail(err)
+	}
+	log.Printf("Monitoring %s running\n", s.scriptPath)
+	s.cmd = cmd
+	s.state = sessionRunning
+	s.exitCode = 0
+	s.stderr = nil
+	s.started = time.Now()
+	s.done = make(chan struct{})
+	s.expired = false
+	var timer *time.Timer
+	if s.timeout > 0 {
+		timer = time.AfterFunc(s.timeout, s.expire)
+	}
+	s.lock.Unlock()
+
+	// Wait closes the pipes, read them to the end first
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		readPipeandSend(cmdStdout, s.comm)
+		readers.Done()
+	}()
+	go func() {
+		readPipe(cmdErr, s.scriptPath+": ", s.appendStderr)
+		readers.Done()
+	}()
+	readers.Wait()
+	err = cmd.Wait()
+	if timer != nil {
+		timer.Stop()
+	}
+	return s.finish(err)
+}
+
+// fail records a tracer that could not be started
+func (s *session) fail(err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = sessionFailed
+	s.exitCode = -1
+	s.stderr = append(s.stderr, err.Error())
+	s.stopping = false
+	return fmt.Errorf("Failed to start %s: %s", s.scriptPath, err)
+}
+
+func (s *session) appendStderr(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stderr = append(s.stderr, line)
+	if len(s.stderr) > stderrTailLines {
+		s.stderr = s.stderr[len(s.stderr)-stderrTailLines:]
+	}
+}
+
+// claim marks the session started, it fails when it already was
+func (s *session) claim() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.claimed {
+		return false
+	}
+	s.claimed = true
+	return true
+}
+
+// IsRunning reports whether the tracer process is still alive
+func (s *session) IsRunning() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state == sessionRunning
+}
+
+// Status returns a copy of the state of the session
+func (s *session) Status() sessionStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state := s.state
+	if state == "" {
+		state = sessionIdle
+	}
+	return sessionStatus{Script: s.scriptPath, Pid: s.pid, State: state, ExitCode: s.exitCode,
+		Started: s.started, Stderr: append([]string{}, s.stderr...)}
+}
+
+// finish records how the tracer exited and wakes up Stop
+func (s *session) finish(err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.exitCode = 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		s.exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		s.exitCode = -1
+	}
+	switch {
+	case s.stopping:
+		s.state = sessionStopped
+		err = nil
+	case s.expired:
+		s.state = sessionTimeout
+		err = fmt.Errorf("%s ran longer than %s", s.scriptPath, s.timeout)
+	case err != nil:
+		s.state = sessionFailed
+		if len(s.stderr) > 0 {
+			err = fmt.Errorf("%s: %s", err, s.stderr[len(s.stderr)-1])
+		}
+	default:
+		s.state = sessionExited
+	}
+	s.cmd = nil
+	s.stopping = false
+	close(s.done)
+	return err
+}
+
+// expire stops the tracer once it ran out of time
+func (s *session) expire() {
+	s.lock.Lock()
+	if s.state != sessionRunning || s.stopping {
+		s.lock.Unlock()
+		return
+	}
+	s.expired = true
+	cmd := s.cmd
+	s.lock.Unlock()
+	log.Printf("%s ran longer than %s, terminate it", s.scriptPath, s.timeout)
+	terminate(cmd, syscall.SIGTERM)
+}
+
+// Stop terminates the tracer process group and waits for it to exit, it is
+// a no-op if the session already exited
+func (s *session) Stop() {
+	s.lock.Lock()
+	if s.state != sessionRunning {
+		// a Run about to start must not start the tracer anymore
+		s.stopping = true
+		s.lock.Unlock()
+		return
+	}
+	cmd, done := s.cmd, s.done
+	s.stopping = true
+	s.lock.Unlock()
+
+	log.Printf("Stop %s", s.scriptPath)
+	terminate(cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		log.Printf("%s did not exit, kill it", s.scriptPath)
+		terminate(cmd, syscall.SIGKILL)
+		<-done
+	}
+}
+
+// terminate signals the process group of the tracer
+func terminate(cmd *exec.Cmd, sig syscall.Signal) {
+	pgid, err := syscall.Getpgid(cmd.Process.Pid)
+	if err != nil {
+		// the process exited between the status check and now
+		return
+	}
+	syscall.Kill(-pgid, sig) // note the minus sign
+}
+
+// readPipe hands every line of the reader to add until it is closed
+func readPipe(reader io.Reader, prefix string, add func(line string)) {
+	r := bufio.NewScanner(reader)
+	for r.Scan() {
+		line := strings.TrimSpace(r.Text())
+		if line == "" {
+			continue
+		}
+		log.Println(prefix + line)
+		add(line)
+	}
+	drain(reader, r.Err())
+}
+
+// readPipeandSend sends every line of the reader to shield until it is closed
+func readPipeandSend(reader io.Reader, localComm communicator.Communicator) {
+	r := bufio.NewScanner(reader)
+	// a plan node of the walk is one line
+	r.Buffer(make([]byte, 64*1024), 1024*1024)
+	for r.Scan() {
+		sendProbe(localComm, r.Text())
+	}
+	drain(reader, r.Err())
+}
+
+// drain discards the rest of a pipe the scanner gave up on, a tracer blocked
+// on a full pipe would never exit
+func drain(reader io.Reader, err error) {
+	if err == nil {
+		return
+	}
+	log.Println("Failed to read the tracer output:", err)
+	io.Copy(ioutil.Discard, reader)
+}
+
+// sendProbe wraps a line printed by the tracer into a probe message
+func sendProbe(localComm communicator.Communicator, line string) {
+	l, err := probe.ParseLine(line)
+	if err != nil {
+		// not one of the lines of the script
+		log.Println(err)
+		return
+	}
+	msg, err := communicator.NewProbeMsg(agentHost, l.Pid, l.Event, l.Payload).Encode()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	localComm.Send("probe", msg)
+}
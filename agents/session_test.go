@@ -0,0 +1,227 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"postTap/communicator"
+	"postTap/probe"
+)
+
+// shellTracer runs the script path as a shell command
+type shellTracer struct{}
+
+// sleepTracer runs every script as a sleep, for the samplers shellTracer
+// can not render
+type sleepTracer struct{ shellTracer }
+
+func (t *sleepTracer) command(script string, pid int, params map[string]string) *exec.Cmd {
+	return exec.Command("sleep", "10")
+}
+
+func (t *shellTracer) extension() string                             { return ".sh" }
+func (t *shellTracer) render(script *probe.Script) string            { return "" }
+func (t *shellTracer) params(script *probe.Script) map[string]string { return nil }
+func (t *shellTracer) command(script string, pid int, params map[string]string) *exec.Cmd {
+	return exec.Command("sh", "-c", script)
+}
+
+// sentComm keeps the decoded probes sent to shield
+type sentComm struct {
+	lock   sync.Mutex
+	probes []*communicator.ProbeMsg
+}
+
+func (c *sentComm) Connect(uri string) error                              { return nil }
+func (c *sentComm) Receive(queue string, p communicator.MessageProcessor) {}
+func (c *sentComm) Close() error                                          { return nil }
+func (c *sentComm) Send(queue string, msg []byte) error {
+	probe, err := communicator.DecodeProbeMsg(msg)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.probes = append(c.probes, probe)
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *sentComm) events() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	events := []string{}
+	for _, p := range c.probes {
+		events = append(events, p.Event)
+	}
+	return events
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionExit(t *testing.T) {
+	comm := &sentComm{}
+	s := &session{scriptPath: `echo '{"pid":7,"event":"ExecutorFinish"}'; echo oops >&2; exit 3`, pid: 7, comm: comm, tracer: &shellTracer{}}
+	if err := s.Run(); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected the exit error with the stderr tail, got %v", err)
+	}
+	status := s.Status()
+	if status.State != sessionFailed || status.ExitCode != 3 || len(status.Stderr) != 1 || status.Stderr[0] != "oops" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if events := comm.events(); len(events) != 1 || events[0] != "ExecutorFinish" {
+		t.Errorf("unexpected probes %v", events)
+	}
+
+	s.scriptPath = "true"
+	if err := s.Run(); err != nil || s.Status().State != sessionExited {
+		t.Errorf("expected a clean exit, got %v %+v", err, s.Status())
+	}
+}
+
+func TestSessionTimeoutAndStop(t *testing.T) {
+	s := &session{scriptPath: "sleep 10", pid: 7, timeout: 50 * time.Millisecond, comm: &sentComm{}, tracer: &shellTracer{}}
+	start := time.Now()
+	if err := s.Run(); err == nil || s.Status().State != sessionTimeout {
+		t.Errorf("expected a timeout, got %v %+v", err, s.Status())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the timeout did not stop the tracer")
+	}
+
+	s.timeout = 0
+	done := make(chan error)
+	go func() { done <- s.Run() }()
+	waitFor(t, "the session to run", s.IsRunning)
+	s.Stop()
+	if err := <-done; err != nil || s.Status().State != sessionStopped {
+		t.Errorf("expected a stopped session, got %v %+v", err, s.Status())
+	}
+	// stopped before it runs
+	s.Stop()
+	if err := s.Run(); err != nil || s.Status().State != sessionStopped {
+		t.Errorf("expected the session not to start, got %v %+v", err, s.Status())
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	comm := &sentComm{}
+	sv := newSupervisor()
+	sv.minBackoff = 10 * time.Millisecond
+	sv.maxBackoff = 40 * time.Millisecond
+
+	// the global session is restarted whenever it exits
+	global := &session{scriptPath: `echo '{"pid":0,"event":"Restarted"}'; exit 1`, comm: comm, tracer: &shellTracer{}}
+	go sv.Keep(global)
+	waitFor(t, "restarts", func() bool { return len(comm.events()) >= 3 })
+
+	// a failed per pid session ends the sampling in shield
+	sv.Start(&session{scriptPath: "exit 2", pid: 9, comm: comm, tracer: &shellTracer{}})
+	waitFor(t, "SessionEnd", func() bool {
+		for _, event := range comm.events() {
+			if event == "SessionEnd" {
+				return true
+			}
+		}
+		return false
+	})
+	running := &session{scriptPath: "sleep 10", pid: 10, comm: comm, tracer: &shellTracer{}}
+	sv.Start(running)
+	waitFor(t, "the session to run", running.IsRunning)
+
+	// the failed session is forgotten
+	status := sv.Status()
+	if len(status) != 2 || status[0].Pid != 0 || status[1].Pid != 10 || status[1].State != sessionRunning {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	sv.Shutdown()
+	if running.Status().State != sessionStopped {
+		t.Errorf("shutdown did not stop %+v", running.Status())
+	}
+	sv.Start(&session{scriptPath: "sleep 10", pid: 11, comm: comm, tracer: &shellTracer{}})
+	if _, ok := sv.Get(11); ok {
+		t.Error("session started after shutdown")
+	}
+}
+
+// shield sends no STOP for a query that finished, its session exits by itself
+func TestSupervisorForgetsExited(t *testing.T) {
+	sv := newSupervisor()
+	exited := &session{scriptPath: `echo '{"pid":12,"event":"SessionEnd"}'`, pid: 12, comm: &sentComm{}, tracer: &shellTracer{}}
+	sv.Start(exited)
+	waitFor(t, "the session to be forgotten", func() bool {
+		sv.lock.Lock()
+		defer sv.lock.Unlock()
+		return len(sv.sessions) == 0
+	})
+	if exited.Status().State != sessionExited {
+		t.Errorf("unexpected status %+v", exited.Status())
+	}
+
+	// a newer session of the reused pid stays
+	old := &session{scriptPath: "sleep 10", pid: 13, comm: &sentComm{}, tracer: &shellTracer{}}
+	sv.Start(old)
+	waitFor(t, "the session to run", old.IsRunning)
+	newer := &session{scriptPath: "sleep 10", pid: 13, comm: &sentComm{}, tracer: &shellTracer{}}
+	sv.Start(newer)
+	old.Stop()
+	if s, ok := sv.Get(13); !ok || s != newer {
+		t.Error("the exit of the old session dropped the newer one")
+	}
+	sv.Shutdown()
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	if len(sv.sessions) != 0 {
+		t.Errorf("sessions left after shutdown %v", sv.sessions)
+	}
+}
+
+// a sampling session runs as long as its query, stap_timeout does not apply
+func TestSamplingSessionTimeout(t *testing.T) {
+	command := &Command{Pid: 14, sessions: newSupervisor(), scriptDir: t.TempDir(), timeout: 10 * time.Second, tracer: &shellTracer{}}
+	if s := command.GetSession(); s.timeout != 10*time.Second {
+		t.Errorf("script session timeout %s", s.timeout)
+	}
+	command.Sampler = &probe.Sampler{Function: "ExecProcNodeInstr"}
+	if s := command.GetSession(); s.timeout != 0 {
+		t.Errorf("sampling session timeout %s", s.timeout)
+	}
+}
+
+// a second START replaces the session of the first even before it runs
+func TestStartTwice(t *testing.T) {
+	sv := newSupervisor()
+	defer sv.Shutdown()
+	command := &Command{sessions: sv, scriptDir: t.TempDir(), tracer: &sleepTracer{}}
+	msg := []byte(`{"CommandName":"START","Pid":15,"Sampler":{"function":"ExecProcNodeInstr"}}`)
+	if err := command.Process(msg); err != nil {
+		t.Fatal(err)
+	}
+	first, ok := sv.Get(15)
+	if !ok {
+		t.Fatal("no session after the first START")
+	}
+	if err := command.Process(msg); err != nil {
+		t.Fatal(err)
+	}
+	second, ok := sv.Get(15)
+	if !ok || second == first {
+		t.Fatal("the second START did not replace the session")
+	}
+	waitFor(t, "the second session to run", second.IsRunning)
+	waitFor(t, "the first session to stop", func() bool { return first.Status().State == sessionStopped })
+	if err := sv.Start(second); err == nil {
+		t.Error("a started session started again")
+	}
+}
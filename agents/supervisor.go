@@ -0,0 +1,205 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"postTap/communicator"
+)
+
+// supervisor owns the tracer sessions of the agent: the global session it
+// keeps running and the per pid sessions shield starts and stops
+type supervisor struct {
+	lock     sync.Mutex
+	global   *session
+	sessions map[int]*session
+	// minBackoff doubles up to maxBackoff while the global session keeps
+	// failing, a session that ran for maxBackoff starts over at minBackoff
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	quit       chan struct{}
+	closing    bool
+	// running counts the goroutines of Start and Keep
+	running sync.WaitGroup
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		sessions:   map[int]*session{},
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		quit:       make(chan struct{}),
+	}
+}
+
+// Keep runs the global session until Shutdown, it is restarted with backoff
+// whenever it exits. Like Start it runs a session once.
+func (sv *supervisor) Keep(s *session) {
+	sv.lock.Lock()
+	if sv.closing {
+		sv.lock.Unlock()
+		return
+	}
+	if !s.claim() {
+		sv.lock.Unlock()
+		log.Printf("Session %s is already started", s.scriptPath)
+		return
+	}
+	sv.global = s
+	sv.running.Add(1)
+	sv.lock.Unlock()
+	defer sv.running.Done()
+
+	backoff := sv.minBackoff
+	for {
+		start := time.Now()
+		err := s.Run()
+		select {
+		case <-sv.quit:
+			return
+		default:
+		}
+		if time.Since(start) >= sv.maxBackoff {
+			backoff = sv.minBackoff
+		}
+		if err == nil {
+			log.Printf("%s exited, restart it in %s", s.scriptPath, backoff)
+		} else {
+			log.Printf("%s, restart it in %s", err, backoff)
+		}
+		select {
+		case <-sv.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > sv.maxBackoff {
+			backoff = sv.maxBackoff
+		}
+	}
+}
+
+// Get returns the session of the pid
+func (sv *supervisor) Get(pid int) (*session, bool) {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	s, ok := sv.sessions[pid]
+	return s, ok
+}
+
+// Start runs the session of its pid, it replaces an earlier session of the
+// pid which must have been stopped. The session is forgotten once it exited,
+// shield sends no STOP for queries that finished. A session that fails or
+// times out tells shield the sampling of the pid ended, shield would wait for
+// it otherwise. A session is started once, a second Start fails.
+func (sv *supervisor) Start(s *session) error {
+	sv.lock.Lock()
+	if sv.closing {
+		sv.lock.Unlock()
+		return nil
+	}
+	if !s.claim() {
+		sv.lock.Unlock()
+		return fmt.Errorf("Session %s of pid %d is already started", s.scriptPath, s.pid)
+	}
+	sv.sessions[s.pid] = s
+	sv.running.Add(1)
+	sv.lock.Unlock()
+	go func() {
+		defer sv.running.Done()
+		err := s.Run()
+		sv.lock.Lock()
+		// the pid may have been reused by a newer session
+		if sv.sessions[s.pid] == s {
+			delete(sv.sessions, s.pid)
+		}
+		sv.lock.Unlock()
+		if err == nil {
+			return
+		}
+		log.Println(err)
+		status := s.Status()
+		if status.State == sessionStopped || s.comm == nil {
+			return
+		}
+		payload := map[string]string{"state": status.State, "exit_code": strconv.Itoa(status.ExitCode)}
+		msg, err := communicator.NewProbeMsg(agentHost, s.pid, "SessionEnd", payload).Encode()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		s.comm.Send("probe", msg)
+	}()
+	return nil
+}
+
+// Stop stops the session of the pid and forgets it
+func (sv *supervisor) Stop(pid int) {
+	sv.lock.Lock()
+	s, ok := sv.sessions[pid]
+	delete(sv.sessions, pid)
+	sv.lock.Unlock()
+	if ok {
+		s.Stop()
+	}
+}
+
+// Shutdown stops all sessions and waits for them to exit, nothing starts
+// after it
+func (sv *supervisor) Shutdown() {
+	sv.lock.Lock()
+	if sv.closing {
+		sv.lock.Unlock()
+		return
+	}
+	sv.closing = true
+	close(sv.quit)
+	sessions := []*session{}
+	if sv.global != nil {
+		sessions = append(sessions, sv.global)
+	}
+	for _, s := range sv.sessions {
+		sessions = append(sessions, s)
+	}
+	sv.lock.Unlock()
+
+	var stopped sync.WaitGroup
+	for _, s := range sessions {
+		stopped.Add(1)
+		go func(s *session) {
+			s.Stop()
+			stopped.Done()
+		}(s)
+	}
+	stopped.Wait()
+	sv.running.Wait()
+}
+
+// Status lists the global session first and the per pid sessions by pid
+func (sv *supervisor) Status() []sessionStatus {
+	sv.lock.Lock()
+	sessions := []*session{}
+	for _, s := range sv.sessions {
+		sessions = append(sessions, s)
+	}
+	global := sv.global
+	sv.lock.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].pid < sessions[j].pid })
+	if global != nil {
+		sessions = append([]*session{global}, sessions...)
+	}
+	status := []sessionStatus{}
+	for _, s := range sessions {
+		status = append(status, s.Status())
+	}
+	return status
+}
+
+// publish exports the sessions with expvar, served on /debug/vars
+func (sv *supervisor) publish() {
+	expvar.Publish("tracer_sessions", expvar.Func(func() interface{} { return sv.Status() }))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"postTap/config"
+	"postTap/probe"
+)
+
+// tracer is the tracing tool the agent attaches its probes with. Every
+// tracer prints the same probe.Line json lines so shield does not know which
+// one runs.
+type tracer interface {
+	// extension is the file extension of the scripts of the tracer
+	extension() string
+	// render writes the probes in the language of the tracer
+	render(script *probe.Script) string
+	// params are the parameters the rendered script is run with
+	params(script *probe.Script) map[string]string
+	// command builds the process running the saved script, pid 0 traces
+	// all backends
+	command(scriptPath string, pid int, params map[string]string) *exec.Cmd
+}
+
+// newTracer returns the tracer the config selects
+func newTracer(conf *config.Config, modules *moduleCache) (tracer, error) {
+	switch conf.Tracer {
+	case "stap":
+		return &stapTracer{cache: modules}, nil
+	case "bpf":
+		return &bpfTracer{}, nil
+	}
+	return nil, fmt.Errorf("Unknown tracer %s", conf.Tracer)
+}
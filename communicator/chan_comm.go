@@ -0,0 +1,99 @@
+package communicator
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const inprocScheme = "inproc://"
+
+// queueSize is the number of messages a queue buffers before Send blocks
+const queueSize = 1024
+
+// bus is a named set of in-process queues
+type bus struct {
+	lock   sync.Mutex
+	queues map[string]chan []byte
+}
+
+var buses = map[string]*bus{}
+var busesLock sync.Mutex
+
+func getBus(name string) *bus {
+	busesLock.Lock()
+	defer busesLock.Unlock()
+	if b, ok := buses[name]; ok {
+		return b
+	}
+	b := &bus{queues: map[string]chan []byte{}}
+	buses[name] = b
+	return b
+}
+
+func (b *bus) queue(name string) chan []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, ok := b.queues[name]; ok {
+		return q
+	}
+	q := make(chan []byte, queueSize)
+	b.queues[name] = q
+	return q
+}
+
+// ChanComm is a Communicator backed by go channels.
+// Every ChanComm connected to the same inproc://name shares the queues,
+// so agent and shield can talk inside one process without a broker.
+type ChanComm struct {
+	bus  *bus
+	done chan struct{}
+	once sync.Once
+}
+
+// Connect attaches to the bus named by uri, e.g. inproc://default
+func (comm *ChanComm) Connect(uri string) error {
+	if !strings.HasPrefix(uri, inprocScheme) {
+		return fmt.Errorf("Unsupported inproc uri: %s", uri)
+	}
+	comm.bus = getBus(strings.TrimPrefix(uri, inprocScheme))
+	comm.done = make(chan struct{})
+	return nil
+}
+
+func (comm *ChanComm) Send(queue string, msg []byte) error {
+	if comm.bus == nil {
+		return fmt.Errorf("Communicator is not connected")
+	}
+	select {
+	case comm.bus.queue(queue) <- msg:
+		return nil
+	case <-comm.done:
+		return fmt.Errorf("Communicator is closed")
+	}
+}
+
+// Receive keep receive from the queue until the communicator is closed
+func (comm *ChanComm) Receive(queue string, p MessageProcessor) {
+	if comm.bus == nil {
+		return
+	}
+	q := comm.bus.queue(queue)
+	log.Printf(" [*] Waiting for %s queue messages. To exit press CTRL+C", queue)
+	for {
+		select {
+		case msg := <-q:
+			p.Process(msg)
+		case <-comm.done:
+			return
+		}
+	}
+}
+
+func (comm *ChanComm) Close() error {
+	if comm.done != nil {
+		comm.once.Do(func() { close(comm.done) })
+	}
+	return nil
+}
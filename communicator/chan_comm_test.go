@@ -0,0 +1,65 @@
+package communicator
+
+import (
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	msgs chan []byte
+}
+
+func (r *recorder) Process(msg []byte) error {
+	r.msgs <- msg
+	return nil
+}
+
+func TestChanCommSharedBus(t *testing.T) {
+	sender, err := NewCommunicator("inproc://test-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewCommunicator("inproc://test-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{msgs: make(chan []byte, 1)}
+	done := make(chan struct{})
+	go func() {
+		receiver.Receive("probe", rec)
+		close(done)
+	}()
+	if err := sender.Send("probe", []byte("1234|ExecutorFinish")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-rec.msgs:
+		if string(msg) != "1234|ExecutorFinish" {
+			t.Errorf("unexpected msg %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+	receiver.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Receive did not return after Close")
+	}
+}
+
+func TestChanCommSeparateBus(t *testing.T) {
+	a, _ := NewCommunicator("inproc://test-a")
+	b, _ := NewCommunicator("inproc://test-b")
+	a.Send("command", []byte("a"))
+	b.Send("command", []byte("b"))
+	if msg := <-getBus("test-b").queue("command"); string(msg) != "b" {
+		t.Errorf("bus leaked messages: %s", msg)
+	}
+}
+
+func TestUnsupportedURI(t *testing.T) {
+	if _, err := NewCommunicator("kafka://localhost"); err == nil {
+		t.Error("expected error for unsupported uri")
+	}
+}
@@ -1,7 +1,21 @@
 package communicator
 
+import "postTap/probe"
+
 type CommandMsg struct {
 	CommandName string
-	Script      []byte
-	Pid         int
+	// Sampler is the sampling session START runs, the agent renders it for
+	// its tracer
+	Sampler *probe.Sampler `json:",omitempty"`
+	Pid     int
+	// Host is the agent owning the backend, empty for single host setups
+	Host string `json:",omitempty"`
+}
+
+// CommandQueue is the queue consumed by the agent of host
+func CommandQueue(host string) string {
+	if host == "" {
+		return "command"
+	}
+	return "command." + host
 }
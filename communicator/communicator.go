@@ -1,7 +1,9 @@
 package communicator
 
 import (
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/streadway/amqp"
 )
@@ -9,10 +11,33 @@ import (
 type MessageProcessor interface {
 	Process(msg []byte) error
 }
+
+// Communicator is the transport between agents and shield
 type Communicator interface {
+	Connect(uri string) error
 	Send(queue string, msg []byte) error
-	Receive(queue string) (<-chan amqp.Delivery, error)
+	// Receive blocks and hands every message of the queue to p
+	Receive(queue string, p MessageProcessor)
+	Close() error
+}
+
+// NewCommunicator picks the transport by the scheme of uri and connects it
+func NewCommunicator(uri string) (Communicator, error) {
+	var comm Communicator
+	switch {
+	case strings.HasPrefix(uri, "amqp://"), strings.HasPrefix(uri, "amqps://"):
+		comm = new(AmqpComm)
+	case strings.HasPrefix(uri, inprocScheme):
+		comm = new(ChanComm)
+	default:
+		return nil, fmt.Errorf("Unsupported communicator uri: %s", uri)
+	}
+	if err := comm.Connect(uri); err != nil {
+		return nil, err
+	}
+	return comm, nil
 }
+
 type AmqpComm struct {
 	conn *amqp.Connection
 }
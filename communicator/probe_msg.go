@@ -0,0 +1,90 @@
+package communicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProbeVersion is the version of ProbeMsg written by this build
+const ProbeVersion = 1
+
+// ProbeMsg is the envelope of every event an agent sends to shield
+type ProbeMsg struct {
+	Version   int               `json:"version"`
+	Host      string            `json:"host,omitempty"`
+	Pid       int               `json:"pid"`
+	Timestamp int64             `json:"timestamp"`
+	Event     string            `json:"event"`
+	Payload   map[string]string `json:"payload,omitempty"`
+}
+
+// NewProbeMsg creates a probe message stamped with the current time
+func NewProbeMsg(host string, pid int, event string, payload map[string]string) *ProbeMsg {
+	return &ProbeMsg{
+		Version:   ProbeVersion,
+		Host:      host,
+		Pid:       pid,
+		Timestamp: time.Now().UnixNano(),
+		Event:     event,
+		Payload:   payload,
+	}
+}
+
+// Encode returns the wire format of the message
+func (probe *ProbeMsg) Encode() ([]byte, error) {
+	return json.Marshal(probe)
+}
+
+// DecodeProbeMsg accepts both the json envelope and the legacy
+// pid|FuncName|k:v,k:v text written by older agents
+func DecodeProbeMsg(msg []byte) (*ProbeMsg, error) {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return parseLegacyProbe(string(trimmed))
+	}
+	probe := new(ProbeMsg)
+	if err := json.Unmarshal(trimmed, probe); err != nil {
+		return nil, fmt.Errorf("Unsupported msg type: %s", err)
+	}
+	if probe.Version < 1 || probe.Version > ProbeVersion {
+		return nil, fmt.Errorf("Unsupported probe version %d", probe.Version)
+	}
+	if probe.Event == "" {
+		return nil, fmt.Errorf("Probe msg without event: %s", msg)
+	}
+	return probe, nil
+}
+
+// parseLegacyProbe parses a pid|FuncName|k:v,k:v line as sent by older agents
+func parseLegacyProbe(line string) (*ProbeMsg, error) {
+	fields := strings.SplitN(line, "|", 3)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Unsupported msg type: %s", line)
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported msg type: %s", line)
+	}
+	probe := &ProbeMsg{Version: ProbeVersion, Pid: pid, Event: fields[1]}
+	if len(fields) == 3 {
+		probe.Payload = parseLegacyPayload(fields[2])
+	}
+	return probe, nil
+}
+
+// parseLegacyPayload splits k:v,k:v and skips fields without a colon
+func parseLegacyPayload(p string) map[string]string {
+	result := map[string]string{}
+	for _, field := range strings.Split(p, ",") {
+		keyval := strings.SplitN(field, ":", 2)
+		if len(keyval) != 2 {
+			continue
+		}
+		result[strings.TrimSpace(keyval[0])] = strings.TrimSpace(keyval[1])
+	}
+	return result
+}
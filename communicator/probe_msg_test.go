@@ -0,0 +1,40 @@
+package communicator
+
+import "testing"
+
+func TestDecodeLegacyProbe(t *testing.T) {
+	probe, err := DecodeProbeMsg([]byte("1234|GenerateNode|plantype:117,plan:0x1ae4630,broken, plan_rows:0x0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Pid != 1234 || probe.Event != "GenerateNode" {
+		t.Errorf("wrong envelope %+v", probe)
+	}
+	if probe.Payload["plan"] != "0x1ae4630" || probe.Payload["plan_rows"] != "0x0" {
+		t.Errorf("wrong payload %v", probe.Payload)
+	}
+	if _, ok := probe.Payload["broken"]; ok {
+		t.Error("field without colon should be skipped")
+	}
+	if _, err := DecodeProbeMsg([]byte("abc|ExecutorFinish")); err == nil {
+		t.Error("expected error for invalid pid")
+	}
+}
+
+func TestProbeRoundTrip(t *testing.T) {
+	probe := NewProbeMsg("seg1", 42, "GetInstrument", map[string]string{"plannode": "0x10", "name": "a,b|c"})
+	msg, err := probe.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeProbeMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Host != "seg1" || decoded.Pid != 42 || decoded.Payload["name"] != "a,b|c" {
+		t.Errorf("round trip mismatch %+v", decoded)
+	}
+	if _, err := DecodeProbeMsg([]byte(`{"version": 99, "pid": 1, "event": "x"}`)); err == nil {
+		t.Error("expected error for unknown version")
+	}
+}
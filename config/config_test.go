@@ -0,0 +1,69 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseDefault(t *testing.T) {
+	c, err := Parse("test", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DBName != "template1" || c.SampleInterval.Duration != time.Second {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posttap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "posttap.json")
+	content := `{"db_name": "postgres", "db_user": "filuser", "sample_interval": "5s"}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("POSTTAP_DB_USER", "envuser")
+	defer os.Unsetenv("POSTTAP_DB_USER")
+
+	c, err := Parse("test", []string{"-config", path, "-sample-interval", "1m", "-instrument-buffers", "true", "-print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DBName != "postgres" {
+		t.Errorf("file value not loaded: %s", c.DBName)
+	}
+	if c.DBUser != "envuser" {
+		t.Errorf("env should override file: %s", c.DBUser)
+	}
+	if c.SampleInterval.Duration != time.Minute {
+		t.Errorf("flag should override file: %s", c.SampleInterval)
+	}
+	if !c.InstrumentBuffers {
+		t.Error("instrument-buffers not set")
+	}
+	if !c.PrintConfig {
+		t.Error("print-config not set")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse("test", []string{"-sample-interval", "0s"}); err == nil {
+		t.Error("expected validation error")
+	}
+	if _, err := Parse("test", []string{"-tracer", "dtrace"}); err == nil {
+		t.Error("expected validation error")
+	}
+	if _, err := Parse("test", []string{"-module-cache-max-entries", "-1"}); err == nil {
+		t.Error("expected validation error")
+	}
+	if _, err := Parse("test", []string{"-stap-timeout", "ten"}); err == nil {
+		t.Error("expected parse error")
+	}
+}
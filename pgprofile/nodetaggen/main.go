@@ -0,0 +1,180 @@
+// Command nodetaggen generates the NodeTag tables of package pgprofile from
+// the nodes.h (and for PG16 and later nodetags.h) of each server version.
+//
+//	nodetaggen -o nodetags_gen.go -consts pg10 headers
+//
+// reads headers/<version>/nodes.h for every version directory.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// explainNames maps T_*State tags to the node type EXPLAIN prints, see
+// ExplainNode in src/backend/commands/explain.c
+var explainNames = map[string]string{
+	"ResultState":              "Result",
+	"ProjectSetState":          "ProjectSet",
+	"ModifyTableState":         "ModifyTable",
+	"AppendState":              "Append",
+	"MergeAppendState":         "Merge Append",
+	"RecursiveUnionState":      "Recursive Union",
+	"BitmapAndState":           "BitmapAnd",
+	"BitmapOrState":            "BitmapOr",
+	"SeqScanState":             "Seq Scan",
+	"SampleScanState":          "Sample Scan",
+	"IndexScanState":           "Index Scan",
+	"IndexOnlyScanState":       "Index Only Scan",
+	"BitmapIndexScanState":     "Bitmap Index Scan",
+	"BitmapHeapScanState":      "Bitmap Heap Scan",
+	"TidScanState":             "Tid Scan",
+	"TidRangeScanState":        "Tid Range Scan",
+	"SubqueryScanState":        "Subquery Scan",
+	"FunctionScanState":        "Function Scan",
+	"TableFuncScanState":       "Table Function Scan",
+	"ValuesScanState":          "Values Scan",
+	"CteScanState":             "CTE Scan",
+	"NamedTuplestoreScanState": "Named Tuplestore Scan",
+	"WorkTableScanState":       "WorkTable Scan",
+	"ForeignScanState":         "Foreign Scan",
+	"CustomScanState":          "Custom Scan",
+	"NestLoopState":            "Nested Loop",
+	"MergeJoinState":           "Merge Join",
+	"HashJoinState":            "Hash Join",
+	"MaterialState":            "Materialize",
+	"MemoizeState":             "Memoize",
+	"SortState":                "Sort",
+	"IncrementalSortState":     "Incremental Sort",
+	"GroupState":               "Group",
+	"AggState":                 "Aggregate",
+	"WindowAggState":           "WindowAgg",
+	"UniqueState":              "Unique",
+	"GatherState":              "Gather",
+	"GatherMergeState":         "Gather Merge",
+	"HashState":                "Hash",
+	"SetOpState":               "SetOp",
+	"LockRowsState":            "LockRows",
+	"LimitState":               "Limit",
+}
+
+// abstractStates never show up in a plan
+var abstractStates = map[string]bool{"PlanState": true, "ScanState": true, "JoinState": true}
+
+// version is the parsed NodeTag enum of one server version
+type version struct {
+	name   string
+	tags   []Tag
+	first  int
+	states []string
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("nodetaggen: ")
+	out := flag.String("o", "nodetags_gen.go", "output file")
+	consts := flag.String("consts", "pg10", "version whose tags are generated as T_* constants")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: nodetaggen [-o file] [-consts version] headerdir")
+	}
+	versions, err := readVersions(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := generate(versions, *consts, flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readVersions parses the headers of every version directory of dir
+func readVersions(dir string) ([]*version, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := []*version{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		tags, err := ParseHeaders(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Name(), err)
+		}
+		first, states, err := stateRange(tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Name(), err)
+		}
+		versions = append(versions, &version{entry.Name(), tags, first, states})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].name < versions[j].name })
+	return versions, nil
+}
+
+// generate renders the go source of the tables, it fails on a plan state
+// without a display name so new upstream nodes are noticed
+func generate(versions []*version, constVersion string, dir string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "// Code generated by nodetaggen from %s/*/nodes.h. DO NOT EDIT.\n\npackage pgprofile\n\n", filepath.ToSlash(dir))
+	missing := []string{}
+	var constTags []Tag
+	for _, v := range versions {
+		if v.name == constVersion {
+			constTags = v.tags
+		}
+		for _, state := range v.states {
+			if _, ok := explainNames[state]; !ok && state != "" && !abstractStates[state] {
+				missing = append(missing, fmt.Sprintf("%s (%s)", state, v.name))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("No EXPLAIN name for %s", strings.Join(missing, ", "))
+	}
+	if constTags == nil {
+		return nil, fmt.Errorf("No headers of %s", constVersion)
+	}
+
+	fmt.Fprintf(buf, "// NodeTag values of %s, other versions are described by their Profile\nconst (\n", constVersion)
+	for _, tag := range constTags {
+		fmt.Fprintf(buf, "%s = %d\n", tag.Name, tag.Value)
+	}
+	fmt.Fprint(buf, ")\n\n")
+
+	fmt.Fprint(buf, "// versionNodeTags holds the plan state tags of each version\nvar versionNodeTags = map[string]nodeTagRange{\n")
+	for _, v := range versions {
+		fmt.Fprintf(buf, "%q: {%d, []string{", v.name, v.first)
+		for i, state := range v.states {
+			if i > 0 {
+				fmt.Fprint(buf, ", ")
+			}
+			fmt.Fprintf(buf, "%q", state)
+		}
+		fmt.Fprint(buf, "}},\n")
+	}
+	fmt.Fprint(buf, "}\n\n")
+
+	states := make([]string, 0, len(explainNames))
+	for state := range explainNames {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	fmt.Fprint(buf, "// planStateNames maps T_*State tags to the names EXPLAIN prints\nvar planStateNames = map[string]string{\n")
+	for _, state := range states {
+		fmt.Fprintf(buf, "%q: %q,\n", state, explainNames[state])
+	}
+	fmt.Fprint(buf, "}\n")
+	return format.Source(buf.Bytes())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tag is one value of the NodeTag enum
+type Tag struct {
+	Name  string
+	Value int
+}
+
+var (
+	blockComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	lineComment  = regexp.MustCompile(`//[^\n]*`)
+	includeLine  = regexp.MustCompile(`(?m)^\s*#\s*include\s+["<]([^">]+)[">]`)
+	enumBody     = regexp.MustCompile(`(?s)typedef\s+enum\s+NodeTag\s*\{(.*?)\}\s*NodeTag\s*;`)
+	tagEntry     = regexp.MustCompile(`^(T_\w+)\s*(?:=\s*(\d+))?$`)
+)
+
+// ParseHeaders reads the NodeTag enum from the nodes.h in dir. Since PG16 the
+// enum body is an #include of the generated nodetags.h, which is read from dir
+// too.
+func ParseHeaders(dir string) ([]Tag, error) {
+	src, err := ioutil.ReadFile(filepath.Join(dir, "nodes.h"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodeTags(string(src), func(name string) (string, error) {
+		src, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(name)))
+		return string(src), err
+	})
+}
+
+// ParseNodeTags returns the NodeTag enum of a nodes.h source in enum order,
+// include reads the files the enum body includes
+func ParseNodeTags(src string, include func(name string) (string, error)) ([]Tag, error) {
+	match := enumBody.FindStringSubmatch(stripComments(src))
+	if match == nil {
+		return nil, fmt.Errorf("No NodeTag enum found")
+	}
+	body := match[1]
+	var err error
+	body = includeLine.ReplaceAllStringFunc(body, func(line string) string {
+		name := includeLine.FindStringSubmatch(line)[1]
+		included, e := include(name)
+		if e != nil && err == nil {
+			err = fmt.Errorf("Failed to include %s: %s", name, e)
+		}
+		return stripComments(included) + ","
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := []Tag{}
+	seen := map[string]bool{}
+	next := 0
+	for _, entry := range strings.Split(body, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		m := tagEntry.FindStringSubmatch(entry)
+		if m == nil {
+			return nil, fmt.Errorf("Unexpected NodeTag entry %q", entry)
+		}
+		if m[2] != "" {
+			next, _ = strconv.Atoi(m[2])
+		}
+		if seen[m[1]] {
+			return nil, fmt.Errorf("Duplicate NodeTag %s", m[1])
+		}
+		seen[m[1]] = true
+		tags = append(tags, Tag{m[1], next})
+		next++
+	}
+	return tags, nil
+}
+
+func stripComments(src string) string {
+	return lineComment.ReplaceAllString(blockComment.ReplaceAllString(src, " "), " ")
+}
+
+// stateRange returns the value of the first plan state tag and the T_*State
+// names up to T_LimitState in enum order, values without a tag are left empty.
+// PG16 made PlanState abstract, there the range starts at T_ResultState.
+func stateRange(tags []Tag) (int, []string, error) {
+	values := map[string]int{}
+	for _, tag := range tags {
+		values[tag.Name] = tag.Value
+	}
+	first, ok := values["T_PlanState"]
+	if !ok {
+		if first, ok = values["T_ResultState"]; !ok {
+			return 0, nil, fmt.Errorf("No T_PlanState or T_ResultState tag")
+		}
+	}
+	last, ok := values["T_LimitState"]
+	if !ok || last < first {
+		return 0, nil, fmt.Errorf("No T_LimitState tag after T_PlanState")
+	}
+	names := make([]string, last-first+1)
+	for _, tag := range tags {
+		if tag.Value >= first && tag.Value <= last {
+			names[tag.Value-first] = strings.TrimPrefix(tag.Name, "T_")
+		}
+	}
+	return first, names, nil
+}
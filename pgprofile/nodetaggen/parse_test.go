@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseNodeTags(t *testing.T) {
+	src := `
+typedef enum NodeTag
+{
+	T_Invalid = 0,
+	/* executor */
+	T_IndexInfo,
+	T_PlanState,		// trailing comment
+	T_ResultState,
+	T_LimitState,
+
+	T_Integer = 200,
+	T_Float
+} NodeTag;`
+	tags, err := ParseNodeTags(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Tag{{"T_Invalid", 0}, {"T_IndexInfo", 1}, {"T_PlanState", 2}, {"T_ResultState", 3}, {"T_LimitState", 4}, {"T_Integer", 200}, {"T_Float", 201}}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("tags %v", tags)
+	}
+	first, states, err := stateRange(tags)
+	if err != nil || first != 2 || !reflect.DeepEqual(states, []string{"PlanState", "ResultState", "LimitState"}) {
+		t.Fatalf("state range %d %v %v", first, states, err)
+	}
+}
+
+// PG16 includes the generated nodetags.h and has no T_PlanState
+func TestParseNodeTagsInclude(t *testing.T) {
+	src := `
+typedef enum NodeTag
+{
+	T_Invalid = 0,
+
+#include "nodes/nodetags.h"
+} NodeTag;`
+	nodetags := `/* generated */
+T_List = 1,
+T_ResultState = 5,
+T_SeqScanState = 6,
+T_LimitState = 8,
+`
+	tags, err := ParseNodeTags(src, func(name string) (string, error) {
+		if name != "nodes/nodetags.h" {
+			return "", fmt.Errorf("unexpected include %s", name)
+		}
+		return nodetags, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, states, err := stateRange(tags)
+	if err != nil || first != 5 || !reflect.DeepEqual(states, []string{"ResultState", "SeqScanState", "", "LimitState"}) {
+		t.Fatalf("state range %d %v %v", first, states, err)
+	}
+}
+
+func TestParseNodeTagsErrors(t *testing.T) {
+	if _, err := ParseNodeTags("typedef int NodeTag;", nil); err == nil {
+		t.Error("expected missing enum error")
+	}
+	if _, err := ParseNodeTags("typedef enum NodeTag { T_A, T_A } NodeTag;", nil); err == nil {
+		t.Error("expected duplicate tag error")
+	}
+	if _, err := ParseNodeTags("typedef enum NodeTag { T_A = T_B + 1 } NodeTag;", nil); err == nil {
+		t.Error("expected unexpected entry error")
+	}
+}
+
+func TestGenerateMissingName(t *testing.T) {
+	v := &version{"pg99", []Tag{{"T_PlanState", 0}}, 0, []string{"PlanState", "FancyScanState", "LimitState"}}
+	if _, err := generate([]*version{v}, "pg99", "headers"); err == nil {
+		t.Error("expected missing EXPLAIN name error")
+	}
+}
@@ -0,0 +1,158 @@
+// Code generated by nodetaggen from headers/*/nodes.h. DO NOT EDIT.
+
+package pgprofile
+
+// NodeTag values of pg10, other versions are described by their Profile
+const (
+	T_Invalid                  = 0
+	T_IndexInfo                = 1
+	T_ExprContext              = 2
+	T_ProjectionInfo           = 3
+	T_JunkFilter               = 4
+	T_ResultRelInfo            = 5
+	T_EState                   = 6
+	T_TupleTableSlot           = 7
+	T_Plan                     = 8
+	T_Result                   = 9
+	T_ProjectSet               = 10
+	T_ModifyTable              = 11
+	T_Append                   = 12
+	T_MergeAppend              = 13
+	T_RecursiveUnion           = 14
+	T_BitmapAnd                = 15
+	T_BitmapOr                 = 16
+	T_Scan                     = 17
+	T_SeqScan                  = 18
+	T_SampleScan               = 19
+	T_IndexScan                = 20
+	T_IndexOnlyScan            = 21
+	T_BitmapIndexScan          = 22
+	T_BitmapHeapScan           = 23
+	T_TidScan                  = 24
+	T_SubqueryScan             = 25
+	T_FunctionScan             = 26
+	T_ValuesScan               = 27
+	T_TableFuncScan            = 28
+	T_CteScan                  = 29
+	T_NamedTuplestoreScan      = 30
+	T_WorkTableScan            = 31
+	T_ForeignScan              = 32
+	T_CustomScan               = 33
+	T_Join                     = 34
+	T_NestLoop                 = 35
+	T_MergeJoin                = 36
+	T_HashJoin                 = 37
+	T_Material                 = 38
+	T_Sort                     = 39
+	T_Group                    = 40
+	T_Agg                      = 41
+	T_WindowAgg                = 42
+	T_Unique                   = 43
+	T_Gather                   = 44
+	T_GatherMerge              = 45
+	T_Hash                     = 46
+	T_SetOp                    = 47
+	T_LockRows                 = 48
+	T_Limit                    = 49
+	T_NestLoopParam            = 50
+	T_PlanRowMark              = 51
+	T_PlanInvalItem            = 52
+	T_PlanState                = 53
+	T_ResultState              = 54
+	T_ProjectSetState          = 55
+	T_ModifyTableState         = 56
+	T_AppendState              = 57
+	T_MergeAppendState         = 58
+	T_RecursiveUnionState      = 59
+	T_BitmapAndState           = 60
+	T_BitmapOrState            = 61
+	T_ScanState                = 62
+	T_SeqScanState             = 63
+	T_SampleScanState          = 64
+	T_IndexScanState           = 65
+	T_IndexOnlyScanState       = 66
+	T_BitmapIndexScanState     = 67
+	T_BitmapHeapScanState      = 68
+	T_TidScanState             = 69
+	T_SubqueryScanState        = 70
+	T_FunctionScanState        = 71
+	T_TableFuncScanState       = 72
+	T_ValuesScanState          = 73
+	T_CteScanState             = 74
+	T_NamedTuplestoreScanState = 75
+	T_WorkTableScanState       = 76
+	T_ForeignScanState         = 77
+	T_CustomScanState          = 78
+	T_JoinState                = 79
+	T_NestLoopState            = 80
+	T_MergeJoinState           = 81
+	T_HashJoinState            = 82
+	T_MaterialState            = 83
+	T_SortState                = 84
+	T_GroupState               = 85
+	T_AggState                 = 86
+	T_WindowAggState           = 87
+	T_UniqueState              = 88
+	T_GatherState              = 89
+	T_GatherMergeState         = 90
+	T_HashState                = 91
+	T_SetOpState               = 92
+	T_LockRowsState            = 93
+	T_LimitState               = 94
+)
+
+// versionNodeTags holds the plan state tags of each version
+var versionNodeTags = map[string]nodeTagRange{
+	"pg10": {53, []string{"PlanState", "ResultState", "ProjectSetState", "ModifyTableState", "AppendState", "MergeAppendState", "RecursiveUnionState", "BitmapAndState", "BitmapOrState", "ScanState", "SeqScanState", "SampleScanState", "IndexScanState", "IndexOnlyScanState", "BitmapIndexScanState", "BitmapHeapScanState", "TidScanState", "SubqueryScanState", "FunctionScanState", "TableFuncScanState", "ValuesScanState", "CteScanState", "NamedTuplestoreScanState", "WorkTableScanState", "ForeignScanState", "CustomScanState", "JoinState", "NestLoopState", "MergeJoinState", "HashJoinState", "MaterialState", "SortState", "GroupState", "AggState", "WindowAggState", "UniqueState", "GatherState", "GatherMergeState", "HashState", "SetOpState", "LockRowsState", "LimitState"}},
+	"pg11": {58, []string{"PlanState", "ResultState", "ProjectSetState", "ModifyTableState", "AppendState", "MergeAppendState", "RecursiveUnionState", "BitmapAndState", "BitmapOrState", "ScanState", "SeqScanState", "SampleScanState", "IndexScanState", "IndexOnlyScanState", "BitmapIndexScanState", "BitmapHeapScanState", "TidScanState", "SubqueryScanState", "FunctionScanState", "TableFuncScanState", "ValuesScanState", "CteScanState", "NamedTuplestoreScanState", "WorkTableScanState", "ForeignScanState", "CustomScanState", "JoinState", "NestLoopState", "MergeJoinState", "HashJoinState", "MaterialState", "SortState", "GroupState", "AggState", "WindowAggState", "UniqueState", "GatherState", "GatherMergeState", "HashState", "SetOpState", "LockRowsState", "LimitState"}},
+	"pg12": {58, []string{"PlanState", "ResultState", "ProjectSetState", "ModifyTableState", "AppendState", "MergeAppendState", "RecursiveUnionState", "BitmapAndState", "BitmapOrState", "ScanState", "SeqScanState", "SampleScanState", "IndexScanState", "IndexOnlyScanState", "BitmapIndexScanState", "BitmapHeapScanState", "TidScanState", "SubqueryScanState", "FunctionScanState", "TableFuncScanState", "ValuesScanState", "CteScanState", "NamedTuplestoreScanState", "WorkTableScanState", "ForeignScanState", "CustomScanState", "JoinState", "NestLoopState", "MergeJoinState", "HashJoinState", "MaterialState", "SortState", "GroupState", "AggState", "WindowAggState", "UniqueState", "GatherState", "GatherMergeState", "HashState", "SetOpState", "LockRowsState", "LimitState"}},
+	"pg13": {59, []string{"PlanState", "ResultState", "ProjectSetState", "ModifyTableState", "AppendState", "MergeAppendState", "RecursiveUnionState", "BitmapAndState", "BitmapOrState", "ScanState", "SeqScanState", "SampleScanState", "IndexScanState", "IndexOnlyScanState", "BitmapIndexScanState", "BitmapHeapScanState", "TidScanState", "SubqueryScanState", "FunctionScanState", "TableFuncScanState", "ValuesScanState", "CteScanState", "NamedTuplestoreScanState", "WorkTableScanState", "ForeignScanState", "CustomScanState", "JoinState", "NestLoopState", "MergeJoinState", "HashJoinState", "MaterialState", "SortState", "IncrementalSortState", "GroupState", "AggState", "WindowAggState", "UniqueState", "GatherState", "GatherMergeState", "HashState", "SetOpState", "LockRowsState", "LimitState"}},
+	"pg14": {61, []string{"PlanState", "ResultState", "ProjectSetState", "ModifyTableState", "AppendState", "MergeAppendState", "RecursiveUnionState", "BitmapAndState", "BitmapOrState", "ScanState", "SeqScanState", "SampleScanState", "IndexScanState", "IndexOnlyScanState", "BitmapIndexScanState", "BitmapHeapScanState", "TidScanState", "TidRangeScanState", "SubqueryScanState", "FunctionScanState", "TableFuncScanState", "ValuesScanState", "CteScanState", "NamedTuplestoreScanState", "WorkTableScanState", "ForeignScanState", "CustomScanState", "JoinState", "NestLoopState", "MergeJoinState", "HashJoinState", "MaterialState", "MemoizeState", "SortState", "IncrementalSortState", "GroupState", "AggState", "WindowAggState", "UniqueState", "GatherState", "GatherMergeState", "HashState", "SetOpState", "LockRowsState", "LimitState"}},
+	"pg15": {62, []string{"PlanState", "ResultState", "ProjectSetState", "ModifyTableState", "AppendState", "MergeAppendState", "RecursiveUnionState", "BitmapAndState", "BitmapOrState", "ScanState", "SeqScanState", "SampleScanState", "IndexScanState", "IndexOnlyScanState", "BitmapIndexScanState", "BitmapHeapScanState", "TidScanState", "TidRangeScanState", "SubqueryScanState", "FunctionScanState", "TableFuncScanState", "ValuesScanState", "CteScanState", "NamedTuplestoreScanState", "WorkTableScanState", "ForeignScanState", "CustomScanState", "JoinState", "NestLoopState", "MergeJoinState", "HashJoinState", "MaterialState", "MemoizeState", "SortState", "IncrementalSortState", "GroupState", "AggState", "WindowAggState", "UniqueState", "GatherState", "GatherMergeState", "HashState", "SetOpState", "LockRowsState", "LimitState"}},
+}
+
+// planStateNames maps T_*State tags to the names EXPLAIN prints
+var planStateNames = map[string]string{
+	"AggState":                 "Aggregate",
+	"AppendState":              "Append",
+	"BitmapAndState":           "BitmapAnd",
+	"BitmapHeapScanState":      "Bitmap Heap Scan",
+	"BitmapIndexScanState":     "Bitmap Index Scan",
+	"BitmapOrState":            "BitmapOr",
+	"CteScanState":             "CTE Scan",
+	"CustomScanState":          "Custom Scan",
+	"ForeignScanState":         "Foreign Scan",
+	"FunctionScanState":        "Function Scan",
+	"GatherMergeState":         "Gather Merge",
+	"GatherState":              "Gather",
+	"GroupState":               "Group",
+	"HashJoinState":            "Hash Join",
+	"HashState":                "Hash",
+	"IncrementalSortState":     "Incremental Sort",
+	"IndexOnlyScanState":       "Index Only Scan",
+	"IndexScanState":           "Index Scan",
+	"LimitState":               "Limit",
+	"LockRowsState":            "LockRows",
+	"MaterialState":            "Materialize",
+	"MemoizeState":             "Memoize",
+	"MergeAppendState":         "Merge Append",
+	"MergeJoinState":           "Merge Join",
+	"ModifyTableState":         "ModifyTable",
+	"NamedTuplestoreScanState": "Named Tuplestore Scan",
+	"NestLoopState":            "Nested Loop",
+	"ProjectSetState":          "ProjectSet",
+	"RecursiveUnionState":      "Recursive Union",
+	"ResultState":              "Result",
+	"SampleScanState":          "Sample Scan",
+	"SeqScanState":             "Seq Scan",
+	"SetOpState":               "SetOp",
+	"SortState":                "Sort",
+	"SubqueryScanState":        "Subquery Scan",
+	"TableFuncScanState":       "Table Function Scan",
+	"TidRangeScanState":        "Tid Range Scan",
+	"TidScanState":             "Tid Scan",
+	"UniqueState":              "Unique",
+	"ValuesScanState":          "Values Scan",
+	"WindowAggState":           "WindowAgg",
+	"WorkTableScanState":       "WorkTable Scan",
+}
@@ -0,0 +1,133 @@
+package pgprofile
+
+import (
+	"sort"
+	"time"
+
+	"postTap/probe"
+)
+
+// QueryEvents are the calls shield follows the state of queries with
+var QueryEvents = []probe.Event{
+	{Function: "ExecutorFinish", Name: "ExecutorFinish"},
+	{Function: "CreateQueryDesc", Name: "CreateQueryDesc"},
+	{Function: "StatementCancelHandler", Name: "StatementCancelHandler"},
+}
+
+// PlanScript is the global session of the agent: the plan walk when a query
+// starts and the query events
+func (p *Profile) PlanScript() *probe.Script {
+	return &probe.Script{Walk: p.PlanWalk(), Events: QueryEvents}
+}
+
+// PlanWalk prints the plan state tree of a query with the members
+// GeneratePlanState of shield reads
+func (p *Profile) PlanWalk() *probe.PlanWalk {
+	walk := &probe.PlanWalk{
+		Function:   "ExecutorRun",
+		RootOffset: p.QueryDescPlanState,
+		Event:      "GenerateNode",
+		Fields: []probe.Field{
+			{Name: "plantype", Type: probe.Int, Path: []int{0}},
+			{Name: "plan", Type: probe.Pointer},
+			{Name: "leftplan", Type: probe.Pointer, Path: []int{p.PlanStateLeftTree}},
+			{Name: "rightplan", Type: probe.Pointer, Path: []int{p.PlanStateRightTree}},
+			{Name: "startup_cost", Type: probe.Long, Path: []int{p.PlanStatePlan, p.PlanStartupCost}},
+			{Name: "total_cost", Type: probe.Long, Path: []int{p.PlanStatePlan, p.PlanTotalCost}},
+			{Name: "plan_rows", Type: probe.Long, Path: []int{p.PlanStatePlan, p.PlanRows}},
+			{Name: "plan_width", Type: probe.Int, Path: []int{p.PlanStatePlan, p.PlanWidth}},
+			{Name: "instrument", Type: probe.Pointer, Path: []int{p.PlanStateInstrument}},
+			{Name: "plan_node_id", Type: probe.Int, Path: []int{p.PlanStatePlan, p.PlanNodeID}},
+		},
+		Done: "PlanReady",
+	}
+	for _, member := range []struct {
+		name   string
+		offset int
+	}{
+		{"parallel_aware", p.PlanParallelAware},
+		{"async_capable", p.PlanAsyncCapable},
+	} {
+		if member.offset != 0 {
+			walk.Fields = append(walk.Fields, probe.Field{Name: member.name, Type: probe.Int8, Path: []int{p.PlanStatePlan, member.offset}})
+		}
+	}
+	if p.GatherNumWorkers != 0 {
+		tags := []int{}
+		for _, name := range []string{"GatherState", "GatherMergeState"} {
+			if tag := p.tagValue(name, true); tag >= 0 {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) > 0 {
+			walk.Fields = append(walk.Fields, probe.Field{Name: "num_workers", Type: probe.Int, Path: []int{p.PlanStatePlan, p.GatherNumWorkers}, Tags: tags})
+		}
+	}
+	list := &probe.List{Length: p.ListLength, Head: p.ListHead, Next: p.ListCellNext, Elements: p.ListElements}
+	if p.SubPlanStateSubPlan != 0 && p.SubPlanSetParam != 0 {
+		walk.Params = &probe.Params{SubPlan: p.SubPlanStateSubPlan, SetParam: p.SubPlanSetParam, List: list}
+	}
+	// in EXPLAIN order
+	walk.Children = append(walk.Children,
+		probe.Child{Kind: probe.ChildList, Relationship: "InitPlan", Offset: p.PlanStateInitPlan, List: list, Elem: p.SubPlanStatePlanState},
+		probe.Child{Kind: probe.ChildPointer, Offset: p.PlanStateLeftTree},
+		probe.Child{Kind: probe.ChildPointer, Offset: p.PlanStateRightTree})
+	for _, member := range []struct {
+		tag    string
+		plans  int
+		nplans int
+	}{
+		{"AppendState", p.AppendPlans, p.AppendNPlans},
+		{"MergeAppendState", p.MergeAppendPlans, p.MergeAppendNPlans},
+		{"BitmapAndState", p.BitmapAndPlans, p.BitmapAndNPlans},
+		{"BitmapOrState", p.BitmapOrPlans, p.BitmapOrNPlans},
+	} {
+		if tag := p.tagValue(member.tag, member.plans != 0); tag >= 0 {
+			walk.Children = append(walk.Children, probe.Child{Kind: probe.ChildArray, Relationship: "Member", Tag: tag, Offset: member.plans, Count: member.nplans})
+		}
+	}
+	if tag := p.tagValue("SubqueryScanState", p.SubqueryScanSubplan != 0); tag >= 0 {
+		walk.Children = append(walk.Children, probe.Child{Kind: probe.ChildPointer, Relationship: "Subquery", Tag: tag, Offset: p.SubqueryScanSubplan})
+	}
+	walk.Children = append(walk.Children,
+		probe.Child{Kind: probe.ChildList, Relationship: "SubPlan", Offset: p.PlanStateSubPlan, List: list, Elem: p.SubPlanStatePlanState})
+	if p.ParallelLeaderVar != "" {
+		walk.Parallel = &probe.Parallel{File: "parallel.c", Leader: p.ParallelLeaderVar, Worker: "ParallelWorkerNumber"}
+	}
+	return walk
+}
+
+// Sampler reports the Instrumentation members of the groups of
+// InstrumentMember for the plan nodes, sorted by group and name
+func (p *Profile) Sampler(groups []string, interval time.Duration) *probe.Sampler {
+	sampler := &probe.Sampler{
+		Function:   p.procNodeFunction(),
+		Interval:   interval,
+		Event:      "GetInstrument",
+		Guard:      p.PlanStateInstrument,
+		Fields:     []probe.Field{{Name: "plannode", Type: probe.Pointer}},
+		Done:       "EndInstrument",
+		Finish:     "ExecutorFinish",
+		RootOffset: p.QueryDescPlanState,
+		End:        "SessionEnd",
+	}
+	groups = append([]string{}, groups...)
+	sort.Strings(groups)
+	members := p.InstrumentMember()
+	for _, group := range groups {
+		names := []string{}
+		for name := range members[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			attr := members[group][name]
+			typ, err := probe.TypeOf(attr.MemberType)
+			if err != nil {
+				continue
+			}
+			sampler.Fields = append(sampler.Fields, probe.Field{Name: name, Type: typ, Path: []int{p.PlanStateInstrument, attr.Offset}})
+		}
+	}
+	return sampler
+}
@@ -0,0 +1,312 @@
+// Package pgprofile holds the struct layouts and NodeTag values of the server
+// versions and builds the probes of a layout. The agents attach the probes,
+// shield reads the plan nodes and names their types with the same profile.
+package pgprofile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+// Layout holds the byte offsets of the struct members the probes read
+type Layout struct {
+	// QueryDesc
+	QueryDescPlanState int `json:"querydesc_planstate"`
+	// PlanState
+	PlanStatePlan       int `json:"planstate_plan"`
+	PlanStateInstrument int `json:"planstate_instrument"`
+	PlanStateLeftTree   int `json:"planstate_lefttree"`
+	PlanStateRightTree  int `json:"planstate_righttree"`
+	PlanStateInitPlan   int `json:"planstate_initplan"`
+	PlanStateSubPlan    int `json:"planstate_subplan"`
+	// Plan
+	PlanStartupCost int `json:"plan_startup_cost"`
+	PlanTotalCost   int `json:"plan_total_cost"`
+	PlanRows        int `json:"plan_rows"`
+	PlanWidth       int `json:"plan_width"`
+	PlanNodeID      int `json:"plan_plan_node_id"`
+	// PlanParallelAware and PlanAsyncCapable are 0 when the version lacks
+	// the member, PG14 added async_capable
+	PlanParallelAware int `json:"plan_parallel_aware,omitempty"`
+	PlanAsyncCapable  int `json:"plan_async_capable,omitempty"`
+	// GatherNumWorkers is num_workers of Gather, GatherMerge begins with
+	// the same members. 0 when unknown.
+	GatherNumWorkers int `json:"gather_num_workers,omitempty"`
+	// Instrumentation
+	InstrRunning    int `json:"instr_running"`
+	InstrTupleCount int `json:"instr_tuplecount"`
+	InstrStartup    int `json:"instr_startup"`
+	InstrTotal      int `json:"instr_total"`
+	InstrNTuples    int `json:"instr_ntuples"`
+	InstrNLoops     int `json:"instr_nloops"`
+	InstrBufUsage   int `json:"instr_bufusage"`
+	// SubPlanState
+	SubPlanStatePlanState int `json:"subplanstate_planstate"`
+	// SubPlanStateSubPlan and SubPlanSetParam lead to the params an init
+	// plan returns, 0 when unknown
+	SubPlanStateSubPlan int `json:"subplanstate_subplan,omitempty"`
+	SubPlanSetParam     int `json:"subplan_setparam,omitempty"`
+	// List is a linked list of ListCells up to PG12 and an array since PG13,
+	// ListHead and ListCellNext are 0 for arrays, ListElements for linked lists
+	ListLength   int `json:"list_length"`
+	ListHead     int `json:"list_head"`
+	ListCellNext int `json:"listcell_next"`
+	ListElements int `json:"list_elements"`
+	// Children of plan state nodes beyond lefttree and righttree, 0 when
+	// unknown, these nodes are not followed then
+	AppendPlans         int `json:"append_appendplans"`
+	AppendNPlans        int `json:"append_nplans"`
+	MergeAppendPlans    int `json:"mergeappend_mergeplans"`
+	MergeAppendNPlans   int `json:"mergeappend_nplans"`
+	BitmapAndPlans      int `json:"bitmapand_bitmapplans"`
+	BitmapAndNPlans     int `json:"bitmapand_nplans"`
+	BitmapOrPlans       int `json:"bitmapor_bitmapplans"`
+	BitmapOrNPlans      int `json:"bitmapor_nplans"`
+	SubqueryScanSubplan int `json:"subqueryscan_subplan"`
+}
+
+// Profile describes the struct layout and NodeTag enum of one server major version
+type Profile struct {
+	Name string `json:"name"`
+	Layout
+	// PlanStateTags are the T_*State names without the T_ prefix in enum
+	// order, the first one has the value FirstPlanStateTag
+	FirstPlanStateTag int      `json:"first_planstate_tag"`
+	PlanStateTags     []string `json:"planstate_tags"`
+	// ParallelLeaderVar is the global holding the leader pid in parallel
+	// workers, parallel workers are not told apart from queries without it
+	ParallelLeaderVar string `json:"parallel_leader_var,omitempty"`
+	// ProcNodeFunction is the function every call of an instrumented plan
+	// node goes through, the sampler probes it. ExecProcNode is inline since
+	// PG10, ExecProcNodeInstr is used when empty.
+	ProcNodeFunction string `json:"procnode_function,omitempty"`
+}
+
+// DefaultProcNodeFunction is called for the plan nodes with instrumentation
+// since PG10, older versions and Greenplum 6 call ExecProcNode
+const DefaultProcNodeFunction = "ExecProcNodeInstr"
+
+// procNodeFunction returns the function the sampler probes
+func (p *Profile) procNodeFunction() string {
+	if p.ProcNodeFunction == "" {
+		return DefaultProcNodeFunction
+	}
+	return p.ProcNodeFunction
+}
+
+// NodeTypeString returns the EXPLAIN name of a T_*State value
+func (p *Profile) NodeTypeString(typeCode int) string {
+	i := typeCode - p.FirstPlanStateTag
+	if i < 0 || i >= len(p.PlanStateTags) {
+		return ""
+	}
+	return planStateNames[p.PlanStateTags[i]]
+}
+
+// InstrAttr is the C type and offset of an Instrumentation member
+type InstrAttr struct {
+	MemberType string
+	Offset     int
+}
+
+// InstrumentMember groups the Instrumentation members by instrument option
+func (p *Profile) InstrumentMember() map[string]map[string]InstrAttr {
+	return map[string]map[string]InstrAttr{
+		"base":        {"tuplecount": {"long", p.InstrTupleCount}, "running": {"int8", p.InstrRunning}},
+		"accumulated": {"startup": {"long", p.InstrStartup}, "total": {"long", p.InstrTotal}, "ntuples": {"long", p.InstrNTuples}, "nloops": {"long", p.InstrNLoops}},
+		"buffer":      p.bufferMember(),
+	}
+}
+
+// bufferCounters are the BufferUsage counters in struct order, all of them
+// long, they kept their place in every version
+var bufferCounters = []string{
+	"shared_blks_hit", "shared_blks_read", "shared_blks_dirtied", "shared_blks_written",
+	"local_blks_hit", "local_blks_read", "local_blks_dirtied", "local_blks_written",
+	"temp_blks_read", "temp_blks_written",
+}
+
+// bufferMember returns the counters of Instrumentation.bufusage
+func (p *Profile) bufferMember() map[string]InstrAttr {
+	result := map[string]InstrAttr{}
+	for i, name := range bufferCounters {
+		result[name] = InstrAttr{"long", p.InstrBufUsage + 8*i}
+	}
+	return result
+}
+
+// tagValue returns the NodeTag value of a T_*State name, -1 when the profile
+// has no such tag or its node can not be followed
+func (p *Profile) tagValue(name string, known bool) int {
+	if !known {
+		return -1
+	}
+	for i, tag := range p.PlanStateTags {
+		if tag == name {
+			return p.FirstPlanStateTag + i
+		}
+	}
+	return -1
+}
+
+//go:generate go run ./nodetaggen -o nodetags_gen.go -consts pg10 headers
+
+// nodeTagRange is the run of plan state tags of one NodeTag enum
+type nodeTagRange struct {
+	first int
+	tags  []string
+}
+
+// PG10 added the ExecProcNode and ExecProcNodeReal pointers to PlanState.
+// Plan kept its size of 104 bytes up to PG16, num_workers follows it.
+var pg10Layout = withChildren(Layout{
+	QueryDescPlanState: 88,
+	PlanStatePlan:      8, PlanStateInstrument: 40, PlanStateLeftTree: 64, PlanStateRightTree: 72,
+	PlanStateInitPlan: 80, PlanStateSubPlan: 88,
+	PlanStartupCost: 8, PlanTotalCost: 16, PlanRows: 24, PlanWidth: 32, PlanNodeID: 40, PlanParallelAware: 36,
+	GatherNumWorkers: 104, InstrRunning: 2, InstrTupleCount: 48, InstrStartup: 168, InstrTotal: 176, InstrNTuples: 184, InstrNLoops: 192, InstrBufUsage: 216,
+	SubPlanStatePlanState: 16, SubPlanStateSubPlan: 8, SubPlanSetParam: 56, ListLength: 4, ListHead: 8, ListCellNext: 8,
+}, 128)
+
+// withLayout returns a copy of base with the changes applied
+func withLayout(base Layout, change func(l *Layout)) Layout {
+	change(&base)
+	return base
+}
+
+// withChildren sets the child arrays of Append, MergeAppend, BitmapAnd,
+// BitmapOr and SubqueryScan, they follow the embedded PlanState of size
+// planStateSize, or the three pointers ScanState adds to it. A size of 0
+// clears them.
+func withChildren(base Layout, planStateSize int) Layout {
+	return withLayout(base, func(l *Layout) {
+		plans, nplans, subplan := 0, 0, 0
+		if planStateSize != 0 {
+			plans, nplans, subplan = planStateSize, planStateSize+8, planStateSize+24
+		}
+		l.AppendPlans, l.AppendNPlans = plans, nplans
+		l.MergeAppendPlans, l.MergeAppendNPlans = plans, nplans
+		l.BitmapAndPlans, l.BitmapAndNPlans = plans, nplans
+		l.BitmapOrPlans, l.BitmapOrNPlans = plans, nplans
+		l.SubqueryScanSubplan = subplan
+	})
+}
+
+// PG11 added worker_jit_instrument and scandesc to PlanState
+var pg11Layout = withChildren(withLayout(pg10Layout, func(l *Layout) {
+	l.PlanStateLeftTree, l.PlanStateRightTree = 72, 80
+	l.PlanStateInitPlan, l.PlanStateSubPlan = 88, 96
+}), 144)
+
+// PG12 added ps_ResultTupleDesc and the slot ops to PlanState
+var pg12Layout = withChildren(pg11Layout, 192)
+
+// PG13 added need_walusage, walusage_start and ntuples2 to Instrumentation
+// and turned List into an array
+var pg13Layout = withLayout(pg12Layout, func(l *Layout) {
+	l.InstrRunning, l.InstrStartup, l.InstrTotal, l.InstrNTuples, l.InstrNLoops = 3, 192, 200, 208, 224
+	l.InstrBufUsage = 248
+	l.ListHead, l.ListCellNext, l.ListElements = 0, 0, 16
+})
+
+// PG14 added async_mode to Instrumentation and async_capable to Plan. The
+// size of PlanState since PG14 is not verified, the child arrays of these
+// versions come from the dwarf profile.
+var pg14Layout = withChildren(withLayout(pg13Layout, func(l *Layout) {
+	l.InstrRunning = 4
+	l.PlanAsyncCapable = 38
+}), 0)
+
+// PG15 added temp_blk_read_time and temp_blk_write_time to BufferUsage
+var pg15Layout = withLayout(pg14Layout, func(l *Layout) {
+	l.InstrStartup, l.InstrTotal, l.InstrNTuples, l.InstrNLoops = 224, 232, 240, 256
+	l.InstrBufUsage = 280
+})
+
+// PG16 shrank instr_time to a single int64
+var pg16Layout = withLayout(pg15Layout, func(l *Layout) {
+	l.InstrTupleCount, l.InstrStartup, l.InstrTotal, l.InstrNTuples, l.InstrNLoops = 32, 176, 184, 192, 208
+	l.InstrBufUsage = 232
+})
+
+// builtin returns a profile with the generated plan state tags of its version
+func builtin(name string, layout Layout) *Profile {
+	tags := versionNodeTags[name]
+	p := &Profile{Name: name, Layout: layout, FirstPlanStateTag: tags.first, PlanStateTags: tags.tags,
+		ProcNodeFunction: DefaultProcNodeFunction}
+	// PG14 renamed ParallelMasterPid to ParallelLeaderPid
+	p.ParallelLeaderVar = "ParallelLeaderPid"
+	if name < "pg14" {
+		p.ParallelLeaderVar = "ParallelMasterPid"
+	}
+	return p
+}
+
+// profiles are the built-in profiles. The NodeTag enum of PG16 is generated
+// into nodetags.h, add its headers to headers/pg16 to build it in, until then
+// the agent reads the tags from the debug info like it does for Greenplum.
+var profiles = map[string]*Profile{
+	"pg10": builtin("pg10", pg10Layout),
+	"pg11": builtin("pg11", pg11Layout),
+	"pg12": builtin("pg12", pg12Layout),
+	"pg13": builtin("pg13", pg13Layout),
+	"pg14": builtin("pg14", pg14Layout),
+	"pg15": builtin("pg15", pg15Layout),
+	"pg16": builtin("pg16", pg16Layout),
+}
+
+// DefaultProfile is the layout postTap was written against
+const DefaultProfile = "pg10"
+
+// RegisterProfile adds or replaces a profile
+func RegisterProfile(p *Profile) {
+	profiles[p.Name] = p
+}
+
+// GetProfile returns the profile of a name like pg12 or gp6
+func GetProfile(name string) (*Profile, error) {
+	if p, ok := profiles[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("No layout profile for %s, provide one with a profile file", name)
+}
+
+// LoadProfile reads a profile from a json file and registers it
+func LoadProfile(path string) (*Profile, error) {
+	bfile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Profile)
+	if err := json.Unmarshal(bfile, p); err != nil {
+		return nil, fmt.Errorf("Invalid profile file %s: %s", path, err)
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("Profile file %s has no name", path)
+	}
+	RegisterProfile(p)
+	return p, nil
+}
+
+var greenplumVersion = regexp.MustCompile(`Greenplum Database\)? (\d+)`)
+var postgresVersion = regexp.MustCompile(`\(PostgreSQL\) (\d+)(\.\d+)?`)
+
+// ProfileName maps the output of postgres --version to a profile name
+func ProfileName(version string) (string, error) {
+	if m := greenplumVersion.FindStringSubmatch(version); m != nil {
+		return "gp" + m[1], nil
+	}
+	m := postgresVersion.FindStringSubmatch(version)
+	if m == nil {
+		return "", fmt.Errorf("Unknown server version: %s", version)
+	}
+	major, _ := strconv.Atoi(m[1])
+	if major < 10 {
+		// before 10 the major version has two parts
+		return "pg" + m[1] + m[2], nil
+	}
+	return "pg" + m[1], nil
+}
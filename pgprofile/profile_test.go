@@ -0,0 +1,183 @@
+package pgprofile
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"postTap/probe"
+)
+
+func TestProfileName(t *testing.T) {
+	cases := map[string]string{
+		"postgres (PostgreSQL) 10.4\n":                                     "pg10",
+		"postgres (PostgreSQL) 16.1 (Ubuntu 16.1-1.pgdg22.04+1)":           "pg16",
+		"postgres (PostgreSQL) 9.6.24":                                     "pg9.6",
+		"postgres (PostgreSQL) 9.4.26 (Greenplum Database 6.20.0 build 1)": "gp6",
+		"postgres (Greenplum Database) 7.0.0 build commit:abc":             "gp7",
+	}
+	for version, expected := range cases {
+		name, err := ProfileName(version)
+		if err != nil || name != expected {
+			t.Errorf("%q: got %s %v, expected %s", version, name, err, expected)
+		}
+	}
+	if _, err := ProfileName("mysqld  Ver 8.0"); err == nil {
+		t.Error("expected error for unknown server")
+	}
+}
+
+func TestProfileNodeTypes(t *testing.T) {
+	pg10, _ := GetProfile("pg10")
+	if pg10.NodeTypeString(T_SeqScanState) != "Seq Scan" || pg10.NodeTypeString(T_LimitState) != "Limit" {
+		t.Error("pg10 profile does not match the T_*State enum")
+	}
+	if profiles[DefaultProfile].NodeTypeString(T_HashJoinState) != "Hash Join" {
+		t.Error("default profile mismatch")
+	}
+	pg14, _ := GetProfile("pg14")
+	// T_SeqScanState is the 11th PlanState tag on every version
+	if pg14.NodeTypeString(pg14.FirstPlanStateTag+10) != "Seq Scan" {
+		t.Error("pg14 seq scan tag mismatch")
+	}
+	if pg14.PlanStateTags[len(pg14.PlanStateTags)-1] != "LimitState" || len(pg14.PlanStateTags) != len(versionNodeTags["pg10"].tags)+3 {
+		t.Errorf("pg14 tags %v", pg14.PlanStateTags)
+	}
+	if _, err := GetProfile("gp6"); err == nil {
+		t.Error("gp6 has no built-in profile, it comes from a profile file or the debug info")
+	}
+}
+
+// every plan node of the built-in versions has its EXPLAIN name
+func TestGeneratedNodeTags(t *testing.T) {
+	for name, tags := range versionNodeTags {
+		p, err := GetProfile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, tag := range tags.tags {
+			if tag == "PlanState" || tag == "ScanState" || tag == "JoinState" {
+				continue
+			}
+			if p.NodeTypeString(tags.first+i) == "" {
+				t.Errorf("%s: no name for %s", name, tag)
+			}
+		}
+	}
+	pg14, _ := GetProfile("pg14")
+	if pg14.NodeTypeString(pg14.FirstPlanStateTag+12) != "Index Scan" || pg14.NodeTypeString(pg14.FirstPlanStateTag+3) != "ModifyTable" {
+		t.Error("pg14 index scan or modify table name mismatch")
+	}
+	if T_PlanState != 53 || T_LimitState != 94 {
+		t.Errorf("pg10 constants shifted: %d %d", T_PlanState, T_LimitState)
+	}
+}
+
+func TestPlanWalk(t *testing.T) {
+	pg11, _ := GetProfile("pg11")
+	walk := pg11.PlanWalk()
+	if walk.RootOffset != 88 || walk.Fields[2].Path[0] != 72 || walk.Parallel == nil || walk.Parallel.Leader != "ParallelMasterPid" {
+		t.Errorf("pg11 walk %+v", walk)
+	}
+	relationships := []string{}
+	for _, child := range walk.Children {
+		relationships = append(relationships, child.Relationship)
+	}
+	if strings.Join(relationships, ",") != "InitPlan,,,Member,Member,Member,Member,Subquery,SubPlan" {
+		t.Errorf("pg11 children %v", relationships)
+	}
+	if walk.Children[3].Tag != pg11.FirstPlanStateTag+4 || walk.Children[3].Offset != 144 {
+		t.Errorf("append child %+v", walk.Children[3])
+	}
+	if list := walk.Children[0].List; list.Head != 8 || list.Elements != 0 {
+		t.Errorf("pg11 list %+v", list)
+	}
+	pg10, _ := GetProfile("pg10")
+	walk = pg10.PlanWalk()
+	if walk.Fields[2].Path[0] != 64 || walk.Fields[3].Path[0] != 72 || walk.Fields[8].Path[0] != 40 {
+		t.Errorf("pg10 fields %+v", walk.Fields)
+	}
+	if walk.Children[0].Offset != 80 || walk.Children[3].Offset != 128 || walk.Children[3].Count != 136 ||
+		walk.Children[7].Offset != 152 || walk.Children[8].Offset != 88 {
+		t.Errorf("pg10 children %+v", walk.Children)
+	}
+	pg12, _ := GetProfile("pg12")
+	if walk = pg12.PlanWalk(); walk.Fields[8].Path[0] != 40 || walk.Children[3].Offset != 192 || walk.Children[8].Offset != 96 {
+		t.Errorf("pg12 walk %+v", walk)
+	}
+	if params := walk.Params; params == nil || params.SubPlan != 8 || params.SetParam != 56 || params.List.Elements != 0 {
+		t.Errorf("pg12 params %+v", params)
+	}
+	pg14, _ := GetProfile("pg14")
+	walk = pg14.PlanWalk()
+	for _, child := range walk.Children {
+		if child.Relationship == "Member" {
+			t.Error("pg14 follows Append members without a verified layout")
+		}
+	}
+	// async_capable follows parallel_aware and parallel_safe
+	fields := walk.Fields[len(walk.Fields)-3:]
+	if fields[0].Name != "parallel_aware" || fields[0].Path[1] != 36 || fields[1].Name != "async_capable" || fields[1].Path[1] != 38 {
+		t.Errorf("pg14 fields %+v", fields)
+	}
+	// num_workers is only read from Gather and Gather Merge
+	gather, gatherMerge := pg14.tagValue("GatherState", true), pg14.tagValue("GatherMergeState", true)
+	if f := fields[2]; f.Name != "num_workers" || f.Path[1] != 104 || len(f.Tags) != 2 || f.Tags[0] != gather || f.Tags[1] != gatherMerge {
+		t.Errorf("pg14 num_workers %+v", f)
+	}
+	if walk.Params.List.Elements != 16 {
+		t.Errorf("pg14 params %+v", walk.Params)
+	}
+}
+
+func TestInstrumentMember(t *testing.T) {
+	pg11, _ := GetProfile("pg11")
+	if pg11.InstrumentMember()["accumulated"]["nloops"].Offset != 192 {
+		t.Error("instrument offset error")
+	}
+	pg16, _ := GetProfile("pg16")
+	buffer := pg16.InstrumentMember()["buffer"]
+	if len(buffer) != 10 || buffer["shared_blks_hit"].Offset != 232 || buffer["temp_blks_written"].Offset != 304 {
+		t.Errorf("buffer offsets %v", buffer)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	pg10, _ := GetProfile("pg10")
+	sampler := pg10.Sampler([]string{"base", "accumulated"}, time.Second)
+	names := []string{}
+	for _, f := range sampler.Fields {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "plannode,nloops,ntuples,startup,total,running,tuplecount" {
+		t.Errorf("sampled fields %v", names)
+	}
+	if f := sampler.Fields[6]; f.Type != probe.Long || f.Path[0] != 40 || f.Path[1] != 48 || sampler.Guard != 40 {
+		t.Errorf("tuplecount %+v guard %d", f, sampler.Guard)
+	}
+	if sampler.Function != "ExecProcNodeInstr" {
+		t.Errorf("pg10 samples %s", sampler.Function)
+	}
+	buffers := pg10.Sampler([]string{"buffer"}, time.Second)
+	if len(buffers.Fields) != 11 || buffers.Fields[6].Name != "shared_blks_hit" || buffers.Fields[6].Path[1] != 216 {
+		t.Errorf("buffer fields %+v", buffers.Fields)
+	}
+}
+
+// ExecProcNode is inline since PG10, older servers name the function in
+// their profile
+func TestProcNodeFunction(t *testing.T) {
+	for _, name := range []string{"pg10", "pg11", "pg12", "pg13", "pg14", "pg15", "pg16"} {
+		p, _ := GetProfile(name)
+		if function := p.Sampler(nil, time.Second).Function; function != "ExecProcNodeInstr" {
+			t.Errorf("%s samples %s", name, function)
+		}
+	}
+	gp6 := &Profile{Name: "gp6", ProcNodeFunction: "ExecProcNode"}
+	if function := gp6.Sampler(nil, time.Second).Function; function != "ExecProcNode" {
+		t.Errorf("gp6 samples %s", function)
+	}
+	if function := (&Profile{Name: "file"}).Sampler(nil, time.Second).Function; function != "ExecProcNodeInstr" {
+		t.Errorf("profile without function samples %s", function)
+	}
+}
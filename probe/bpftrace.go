@@ -0,0 +1,302 @@
+package probe
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+func (t Type) bpfFormat() string {
+	switch t {
+	case Int:
+		return "%d"
+	case Int8:
+		return "0x%x"
+	}
+	return "0x%lx"
+}
+
+func (t Type) bpfCast() string {
+	switch t {
+	case Int:
+		return "int32"
+	case Int8:
+		return "uint8"
+	}
+	return "uint64"
+}
+
+// bpfRead reads a member of the traced process
+func bpfRead(cast string, expr string, offset int) string {
+	return fmt.Sprintf("*(%s *)uptr(%s + %d)", cast, expr, offset)
+}
+
+func (f Field) bpfExpr(base string) string {
+	if len(f.Path) == 0 {
+		return base
+	}
+	expr := base
+	for _, offset := range f.Path[:len(f.Path)-1] {
+		expr = bpfRead("uint64", expr, offset)
+	}
+	return bpfRead(f.Type.bpfCast(), expr, f.Path[len(f.Path)-1])
+}
+
+// bpfFields returns the format of the payload members and the arguments of
+// the fields, fields with tags are read into the variable of their name by
+// bpfTagged
+func bpfFields(fields []Field, base string) (string, []string) {
+	formats, args := []string{}, []string{}
+	for _, f := range fields {
+		formats = append(formats, member(f.Name, f.Type.bpfFormat()))
+		if len(f.Tags) > 0 {
+			args = append(args, "$"+f.Name)
+		} else {
+			args = append(args, f.bpfExpr(base))
+		}
+	}
+	return strings.Join(formats, ","), args
+}
+
+// bpfTagged reads the fields with tags of the node in $node into variables,
+// 0 for the nodes of other tags
+func bpfTagged(buf *bytes.Buffer, fields []Field) {
+	for _, f := range fields {
+		if len(f.Tags) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "        $%s = 0;\n        if (%s) {\n            $%s = %s;\n        }\n", f.Name, tagCond("$tag", f.Tags), f.Name, f.bpfExpr("$node"))
+	}
+}
+
+// BPFTrace renders the script for bpftrace. bpftrace compiles the script on
+// every run, the plan of the sampler is written into it.
+func BPFTrace(s *Script) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("#!/usr/bin/env bpftrace\n// generated by postTap from its probe definitions\n")
+	maps := []string{}
+	if s.Walk != nil {
+		bpfWalk(buf, s.Binary, s.Walk)
+		maps = append(maps, "@relationships", "@node", "@parent", "@rel", "@cells")
+		if s.Walk.Params != nil {
+			maps = append(maps, "@elem")
+		}
+	}
+	if s.Sampler != nil {
+		bpfSampler(buf, s.Binary, s.Sampler)
+		maps = append(maps, "@last_sample")
+	}
+	for _, e := range s.Events {
+		fmt.Fprintf(buf, "\nuprobe:%s:%s\n{\n    printf(%s, pid);\n}\n", s.Binary, e.Function, literal(lineFormat(e.Name, "")))
+	}
+	if len(maps) > 0 {
+		// bpftrace prints the maps left at exit
+		buf.WriteString("\nEND\n{\n")
+		for _, m := range maps {
+			fmt.Fprintf(buf, "    clear(%s);\n", m)
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.String()
+}
+
+// bpfWalk keeps the stack of the walk in maps keyed by pid, bpftrace has no
+// functions so the children are pushed inline
+func bpfWalk(buf *bytes.Buffer, binary string, w *PlanWalk) {
+	relationships := w.relationships()
+	buf.WriteString("\nBEGIN\n{\n")
+	for i, r := range relationships {
+		fmt.Fprintf(buf, "    @relationships[%d] = \"%s\";\n", i, r)
+	}
+	buf.WriteString("}\n")
+
+	format, args := bpfFields(w.Fields, "$node")
+	format += "," + member("parent", "0x%lx") + "," + member("relationship", "%s")
+	args = append(args, "$parent", "@relationships[$r]")
+	if w.Params != nil {
+		format += "," + member("setparam", "%d") + "," + member("setparams", "%d")
+		args = append(args, "$setparam", "$setparams")
+	}
+	format += "," + member("root", "0x%lx") + "," + member("seq", "%d")
+	args = append(args, "$root", "$seq")
+
+	fmt.Fprintf(buf, "\nuprobe:%s:%s\n{\n", binary, w.Function)
+	fmt.Fprintf(buf, "    $root = %s;\n", bpfRead("uint64", "arg0", w.RootOffset))
+	if w.Parallel != nil {
+		fmt.Fprintf(buf, "    $worker = *(int32 *)uaddr(\"%s\");\n", w.Parallel.Worker)
+		fmt.Fprintf(buf, "    $leader = *(int32 *)uaddr(\"%s\");\n", w.Parallel.Leader)
+	}
+	fmt.Fprintf(buf, `    $seq = 0;
+    $top = 0;
+    if ($root != 0) {
+        @node[pid, 0] = $root;
+        @parent[pid, 0] = 0;
+        @rel[pid, 0] = 0;
+        $top = 1;
+    }
+    // bounded for the verifier, larger plans are cut
+    while ($top > 0 && $seq < %d) {
+        $top--;
+        $node = @node[pid, $top];
+        $parent = @parent[pid, $top];
+        $r = @rel[pid, $top];
+        delete(@node[pid, $top]);
+        delete(@parent[pid, $top]);
+        delete(@rel[pid, $top]);
+        $tag = *(int32 *)uptr($node);
+`, MaxNodes)
+	bpfParams(buf, w.Params)
+	bpfTagged(buf, w.Fields)
+	if w.Parallel != nil {
+		worker := format + "," + member("leader", "%d") + "," + member("worker", "%d")
+		fmt.Fprintf(buf, "        if ($worker >= 0) {\n            printf(%s, pid, %s, $leader, $worker);\n        } else {\n    ",
+			literal(lineFormat(w.Event, worker)), strings.Join(args, ", "))
+	}
+	fmt.Fprintf(buf, "        printf(%s, pid, %s);\n", literal(lineFormat(w.Event, format)), strings.Join(args, ", "))
+	if w.Parallel != nil {
+		buf.WriteString("        }\n")
+	}
+	buf.WriteString("        $seq++;\n\n        // pushed in reverse of the EXPLAIN order\n")
+	for i := len(w.Children) - 1; i >= 0; i-- {
+		c := w.Children[i]
+		rel := 0
+		for j, r := range relationships {
+			if r == c.Relationship {
+				rel = j
+			}
+		}
+		bpfPushChild(buf, c, rel, w.Params != nil)
+	}
+	fmt.Fprintf(buf, "    }\n    // shield starts sampling once it has all nodes\n    printf(%s, pid, $seq);\n}\n", literal(lineFormat(w.Done, member("nodes", "%d"))))
+}
+
+// bpfParams reads the params an init plan returns into $setparam and
+// $setparams, the SubPlanState of the node was pushed in @elem
+func bpfParams(buf *bytes.Buffer, p *Params) {
+	if p == nil {
+		return
+	}
+	first := p.List.Head
+	if p.List.Elements != 0 {
+		first = p.List.Elements
+	}
+	fmt.Fprintf(buf, `        $elem = @elem[pid, $top];
+        delete(@elem[pid, $top]);
+        $setparam = 0;
+        $setparams = 0;
+        if ($elem != 0) {
+            $params = %s;
+            if ($params != 0) {
+                $setparam = %s;
+                $setparams = %s;
+            }
+        }
+`, bpfRead("uint64", bpfRead("uint64", "$elem", p.SubPlan), p.SetParam),
+		bpfRead("int32", bpfRead("uint64", "$params", first), 0), bpfRead("int32", "$params", p.List.Length))
+}
+
+// bpfPush pushes the plan state in $child, elem is the List element holding
+// it, empty when the walk does not keep it
+func bpfPush(buf *bytes.Buffer, indent string, c Child, rel int, elem string) {
+	parent := "$node"
+	if c.Relationship == "" {
+		parent = "0"
+	}
+	fmt.Fprintf(buf, "%sif ($child != 0) {\n", indent)
+	fmt.Fprintf(buf, "%s    @node[pid, $top] = $child;\n%s    @parent[pid, $top] = %s;\n%s    @rel[pid, $top] = %d;\n",
+		indent, indent, parent, indent, rel)
+	if elem != "" {
+		fmt.Fprintf(buf, "%s    @elem[pid, $top] = %s;\n", indent, elem)
+	}
+	fmt.Fprintf(buf, "%s    $top++;\n%s}\n", indent, indent)
+}
+
+// bpfPushChild pushes the children c refers to, the List elements are kept
+// in @elem with params
+func bpfPushChild(buf *bytes.Buffer, c Child, rel int, params bool) {
+	indent := "        "
+	if c.Tag != 0 {
+		fmt.Fprintf(buf, "%sif ($tag == %d) {\n", indent, c.Tag)
+		indent += "    "
+	}
+	switch c.Kind {
+	case ChildPointer:
+		fmt.Fprintf(buf, "%s$child = %s;\n", indent, bpfRead("uint64", "$node", c.Offset))
+		bpfPush(buf, indent, c, rel, "")
+	case ChildArray:
+		fmt.Fprintf(buf, "%s$plans = %s;\n", indent, bpfRead("uint64", "$node", c.Offset))
+		fmt.Fprintf(buf, "%s$n = %s;\n", indent, bpfRead("int32", "$node", c.Count))
+		fmt.Fprintf(buf, "%sif ($n > %d) {\n%s    $n = %d;\n%s}\n", indent, maxChildren, indent, maxChildren, indent)
+		fmt.Fprintf(buf, "%swhile ($n > 0) {\n%s    $n--;\n", indent, indent)
+		fmt.Fprintf(buf, "%s    $child = *(uint64 *)uptr($plans + 8 * $n);\n", indent)
+		bpfPush(buf, indent+"    ", c, rel, "")
+		fmt.Fprintf(buf, "%s}\n", indent)
+	case ChildList:
+		// the cells are read forwards and pushed backwards
+		fmt.Fprintf(buf, "%s$list = %s;\n%s$n = 0;\n", indent, bpfRead("uint64", "$node", c.Offset), indent)
+		fmt.Fprintf(buf, "%sif ($list != 0) {\n", indent)
+		fmt.Fprintf(buf, "%s    $len = %s;\n", indent, bpfRead("int32", "$list", c.List.Length))
+		if c.List.Elements != 0 {
+			fmt.Fprintf(buf, "%s    $elements = %s;\n", indent, bpfRead("uint64", "$list", c.List.Elements))
+			fmt.Fprintf(buf, "%s    while ($n < $len && $n < %d) {\n", indent, maxChildren)
+			fmt.Fprintf(buf, "%s        @cells[pid, $n] = *(uint64 *)uptr($elements + 8 * $n);\n", indent)
+		} else {
+			fmt.Fprintf(buf, "%s    $cell = %s;\n", indent, bpfRead("uint64", "$list", c.List.Head))
+			fmt.Fprintf(buf, "%s    while ($n < $len && $n < %d && $cell != 0) {\n", indent, maxChildren)
+			fmt.Fprintf(buf, "%s        @cells[pid, $n] = *(uint64 *)uptr($cell);\n", indent)
+			fmt.Fprintf(buf, "%s        $cell = %s;\n", indent, bpfRead("uint64", "$cell", c.List.Next))
+		}
+		fmt.Fprintf(buf, "%s        $n++;\n%s    }\n%s}\n", indent, indent, indent)
+		fmt.Fprintf(buf, "%swhile ($n > 0) {\n%s    $n--;\n", indent, indent)
+		fmt.Fprintf(buf, "%s    $item = @cells[pid, $n];\n", indent)
+		fmt.Fprintf(buf, "%s    $child = %s;\n", indent, bpfRead("uint64", "$item", c.Elem))
+		fmt.Fprintf(buf, "%s    delete(@cells[pid, $n]);\n", indent)
+		elem := ""
+		if params {
+			elem = "$item"
+		}
+		bpfPush(buf, indent+"    ", c, rel, elem)
+		fmt.Fprintf(buf, "%s}\n", indent)
+	}
+	if c.Tag != 0 {
+		buf.WriteString("        }\n")
+	}
+}
+
+func bpfSampler(buf *bytes.Buffer, binary string, s *Sampler) {
+	sample := new(bytes.Buffer)
+	format, _ := bpfFields(s.Fields, "")
+	for _, node := range s.Nodes {
+		base := fmt.Sprintf("%d", node)
+		_, args := bpfFields(s.Fields, base)
+		indent := "    "
+		if s.Guard != 0 {
+			fmt.Fprintf(sample, "    if (%s != 0) {\n", bpfRead("uint64", base, s.Guard))
+			indent += "    "
+		}
+		fmt.Fprintf(sample, "%sprintf(%s, pid, %s);\n", indent, literal(lineFormat(s.Event, format)), strings.Join(args, ", "))
+		if s.Guard != 0 {
+			sample.WriteString("    }\n")
+		}
+	}
+	fmt.Fprintf(sample, "    printf(%s, pid);\n", literal(lineFormat(s.Done, "")))
+
+	fmt.Fprintf(buf, `
+// the instrumentation is only readable from the backend, sample on the first
+// call after the interval passed
+uprobe:%s:%s
+/nsecs - @last_sample >= %d/
+{
+    @last_sample = nsecs;
+%s}
+
+// the last sample, queries run by the query like functions do not end it
+uprobe:%s:%s
+/%s == %d/
+{
+%s    printf(%s, pid);
+    exit();
+}
+`, binary, s.Function, s.Interval.Nanoseconds(), sample.String(),
+		binary, s.Finish, bpfRead("uint64", "arg0", s.RootOffset), s.Root, sample.String(), literal(lineFormat(s.End, "")))
+}
@@ -0,0 +1,246 @@
+// Package probe describes the probes postTap attaches to the server without
+// the syntax of a tracer. Stap and BPFTrace render the same description, so
+// every tracer prints the same json lines.
+package probe
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Type is the C type of a member read from the traced process
+type Type int
+
+const (
+	// Long is 8 bytes printed in hex, doubles keep their bits this way
+	Long Type = iota
+	// Int is 4 bytes printed in decimal
+	Int
+	// Int8 is 1 byte printed in hex
+	Int8
+	// Pointer is an address printed in hex
+	Pointer
+)
+
+// TypeOf returns the type of a C type name like long or int8
+func TypeOf(name string) (Type, error) {
+	switch name {
+	case "long":
+		return Long, nil
+	case "int":
+		return Int, nil
+	case "int8":
+		return Int8, nil
+	case "pointer":
+		return Pointer, nil
+	}
+	return 0, fmt.Errorf("Unknown member type %s", name)
+}
+
+// Field is a value printed as Name:value. Path holds the offsets from the
+// base pointer: the members before the last one are pointers followed, the
+// last one is the member read. An empty path prints the base pointer itself.
+type Field struct {
+	Name string `json:"name"`
+	Type Type   `json:"type"`
+	Path []int  `json:"path,omitempty"`
+	// Tags limits the field of a walk to the nodes with one of the NodeTags,
+	// the others print 0. Samplers read every field.
+	Tags []int `json:"tags,omitempty"`
+}
+
+// tagCond is the condition of the tags on the NodeTag in tag, stap and
+// bpftrace write it alike
+func tagCond(tag string, tags []int) string {
+	conds := []string{}
+	for _, t := range tags {
+		conds = append(conds, fmt.Sprintf("%s == %d", tag, t))
+	}
+	return strings.Join(conds, " || ")
+}
+
+// Event prints Name with the pid on every call of Function
+type Event struct {
+	Function string `json:"function"`
+	Name     string `json:"name"`
+}
+
+// ChildKind tells how a plan state node refers to a child
+type ChildKind int
+
+const (
+	// ChildPointer is a PlanState pointer member
+	ChildPointer ChildKind = iota
+	// ChildArray is an array of PlanState pointers with its length in Count
+	ChildArray
+	// ChildList is a List of nodes holding the plan state at Elem
+	ChildList
+)
+
+// List is the layout of a List, Elements is set for the array lists of
+// PG13 and later, Head and Next for the linked lists before
+type List struct {
+	Length   int `json:"length"`
+	Head     int `json:"head"`
+	Next     int `json:"next"`
+	Elements int `json:"elements"`
+}
+
+// Child is a way from a plan state node to its children
+type Child struct {
+	Kind ChildKind `json:"kind"`
+	// Relationship is printed with the parent, empty for lefttree and
+	// righttree whose parent shield knows from the parent itself
+	Relationship string `json:"relationship,omitempty"`
+	// Tag limits the child to nodes with the NodeTag, 0 for all nodes
+	Tag    int `json:"tag,omitempty"`
+	Offset int `json:"offset"`
+	// Count is the offset of the array length of ChildArray
+	Count int `json:"count,omitempty"`
+	// List and Elem describe ChildList
+	List *List `json:"list,omitempty"`
+	Elem int   `json:"elem,omitempty"`
+}
+
+// Parallel names the globals of File telling parallel workers apart
+type Parallel struct {
+	File   string `json:"file"`
+	Leader string `json:"leader"`
+	Worker string `json:"worker"`
+}
+
+// Params reads the setParam list of the SubPlan a SubPlanState list element
+// points to at SubPlan, the params an init plan returns. Their ids are
+// consecutive, the walk prints the first one as setparam and their number as
+// setparams.
+type Params struct {
+	SubPlan  int   `json:"subplan"`
+	SetParam int   `json:"setparam"`
+	List     *List `json:"list"`
+}
+
+// PlanWalk prints the plan state tree when Function starts a query. Every
+// node is printed as Event with Fields read from the node, followed by
+// parent and relationship for children beyond lefttree and righttree, the
+// params of children of ChildList when Params is set, the root, the walk
+// position seq and for parallel workers leader and worker. Done is printed
+// with the number of nodes after the last one.
+type PlanWalk struct {
+	Function string `json:"function"`
+	// RootOffset is the offset of the root plan state in the first argument
+	RootOffset int       `json:"root_offset"`
+	Event      string    `json:"event"`
+	Fields     []Field   `json:"fields"`
+	Children   []Child   `json:"children"`
+	Params     *Params   `json:"params,omitempty"`
+	Parallel   *Parallel `json:"parallel,omitempty"`
+	Done       string    `json:"done"`
+}
+
+// MaxNodes bounds the walk, larger plans are cut, and so the nodes of a
+// sampler
+const MaxNodes = 1000
+
+// MaxStringLen is the string size stap needs for the nodes param of a
+// sampler of MaxNodes nodes, 16 hex digits and a comma each
+const MaxStringLen = MaxNodes*17 + 1
+
+// maxChildren bounds the arrays and lists of one node likewise
+const maxChildren = 100
+
+// Sampler reports Event with Fields of every plan node of one query on the
+// first call of Function after Interval passed, nodes whose Guard pointer is
+// null are skipped. Done follows each sample. The call of Finish whose first
+// argument holds Root at RootOffset takes a last sample, prints End and ends
+// the session.
+type Sampler struct {
+	Function string        `json:"function"`
+	Interval time.Duration `json:"interval"`
+	Event    string        `json:"event"`
+	// Guard is the offset of a pointer in the node, 0 for none
+	Guard      int      `json:"guard,omitempty"`
+	Fields     []Field  `json:"fields"`
+	Done       string   `json:"done"`
+	Finish     string   `json:"finish"`
+	RootOffset int      `json:"root_offset"`
+	End        string   `json:"end"`
+	Root       uint64   `json:"root"`
+	Nodes      []uint64 `json:"nodes"`
+}
+
+// Params returns Root and Nodes as the module parameters of the stap
+// rendering, which does not depend on the plan. MaxNodes nodes fit in
+// MaxStringLen.
+func (s *Sampler) Params() map[string]string {
+	nodes := []string{}
+	for _, node := range s.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%x", node))
+	}
+	return map[string]string{"root": fmt.Sprintf("%d", s.Root), "nodes": strings.Join(nodes, ",")}
+}
+
+// Script is everything one tracer session attaches to Binary
+type Script struct {
+	Binary  string
+	Walk    *PlanWalk
+	Sampler *Sampler
+	Events  []Event
+}
+
+// relationships returns the relationships of the children, "" first
+func (w *PlanWalk) relationships() []string {
+	result := []string{""}
+	for _, child := range w.Children {
+		known := false
+		for _, r := range result {
+			known = known || r == child.Relationship
+		}
+		if !known {
+			result = append(result, child.Relationship)
+		}
+	}
+	return result
+}
+
+// Line is what the scripts print for every probe, one json object a line
+// like {"pid":1234,"event":"GenerateNode","payload":{"plan":"0x1ae4630"}}.
+// The payload values are numbers and the names of the probe description,
+// the scripts print them without escaping.
+type Line struct {
+	Pid     int               `json:"pid"`
+	Event   string            `json:"event"`
+	Payload map[string]string `json:"payload,omitempty"`
+}
+
+// ParseLine decodes a line printed by a script
+func ParseLine(line string) (*Line, error) {
+	l := new(Line)
+	if err := json.Unmarshal([]byte(line), l); err != nil {
+		return nil, fmt.Errorf("Invalid probe line %q: %s", line, err)
+	}
+	if l.Event == "" {
+		return nil, fmt.Errorf("Probe line without event: %s", line)
+	}
+	return l, nil
+}
+
+// lineFormat is the printf format of a Line of event, payload is the format
+// of the payload members, empty for none
+func lineFormat(event string, payload string) string {
+	if payload == "" {
+		return `{"pid":%d,"event":"` + event + `"}\n`
+	}
+	return `{"pid":%d,"event":"` + event + `","payload":{` + payload + `}}\n`
+}
+
+// member is the format of a payload member
+func member(name string, format string) string {
+	return `"` + name + `":"` + format + `"`
+}
+
+// literal is the string literal of a format in stap and bpftrace
+func literal(format string) string {
+	return `"` + strings.Replace(format, `"`, `\"`, -1) + `"`
+}
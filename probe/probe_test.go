@@ -0,0 +1,185 @@
+package probe
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testWalk() *PlanWalk {
+	list := &List{Length: 4, Head: 8, Next: 8}
+	return &PlanWalk{
+		Function:   "ExecutorRun",
+		RootOffset: 88,
+		Event:      "GenerateNode",
+		Fields: []Field{
+			{Name: "plantype", Type: Int, Path: []int{0}},
+			{Name: "plan", Type: Pointer},
+			{Name: "plan_rows", Type: Long, Path: []int{8, 24}},
+		},
+		Children: []Child{
+			{Kind: ChildList, Relationship: "InitPlan", Offset: 64, List: list, Elem: 16},
+			{Kind: ChildPointer, Offset: 48},
+			{Kind: ChildArray, Relationship: "Member", Tag: 58, Offset: 112, Count: 120},
+			{Kind: ChildList, Relationship: "SubPlan", Offset: 72, List: list, Elem: 16},
+		},
+		Params:   &Params{SubPlan: 8, SetParam: 56, List: list},
+		Parallel: &Parallel{File: "parallel.c", Leader: "ParallelMasterPid", Worker: "ParallelWorkerNumber"},
+		Done:     "PlanReady",
+	}
+}
+
+func testSampler(root uint64, nodes ...uint64) *Sampler {
+	return &Sampler{
+		Function: "ExecProcNode",
+		Interval: time.Second,
+		Event:    "GetInstrument",
+		Guard:    24,
+		Fields: []Field{
+			{Name: "plannode", Type: Pointer},
+			{Name: "running", Type: Int8, Path: []int{24, 2}},
+			{Name: "tuplecount", Type: Long, Path: []int{24, 48}},
+		},
+		Done:       "EndInstrument",
+		Finish:     "ExecutorFinish",
+		RootOffset: 88,
+		End:        "SessionEnd",
+		Root:       root,
+		Nodes:      nodes,
+	}
+}
+
+func contains(t *testing.T, name string, script string, parts ...string) {
+	for _, part := range parts {
+		if !strings.Contains(script, part) {
+			t.Errorf("%s lacks %q", name, part)
+		}
+	}
+}
+
+func TestStap(t *testing.T) {
+	script := Stap(&Script{Binary: "/bin/postgres", Walk: testWalk(), Events: []Event{{"ExecutorFinish", "ExecutorFinish"}}})
+	contains(t, "walk", script,
+		`probe process("/bin/postgres").function("ExecutorRun").call`,
+		`return sprintf("\"plantype\":\"%d\",\"plan\":\"%p\",\"plan_rows\":\"%p\"", user_int(node+0), node, user_long(user_long(node+8)+24))`,
+		`planstate_root = user_long(long_arg(1)+88)`,
+		`worker = @var("ParallelWorkerNumber@parallel.c")`,
+		`@var("ParallelMasterPid@parallel.c"), worker)`,
+		"        if (tag == 58) {\n            push_array(lpid, user_long(node+112), user_int(node+120), node, \"Member\")\n        }\n",
+		`push_node(lpid, user_long(node+48), 0, "", 0)`,
+		`params = user_long(user_long(elem+8)+56)`,
+		`return sprintf(",\"setparam\":\"%d\",\"setparams\":\"%d\"", user_int(user_long(params+8)), user_int(params+4))`,
+		`parse_parent(parent, relationship) . parse_params(elem) . sprintf(",\"root\":\"%p\",\"seq\":\"%d\"", planstate_root, seq++)`,
+		`printf("{\"pid\":%d,\"event\":\"PlanReady\",\"payload\":{%s}}\n", lpid, sprintf("\"nodes\":\"%d\"", seq))`,
+		"function(\"ExecutorFinish\").call\n{\n"+`    printf("{\"pid\":%d,\"event\":\"ExecutorFinish\"}\n", pid())`+"\n}")
+	// pushed backwards so init plans come first
+	if strings.Index(script, `"SubPlan")`) > strings.Index(script, `"InitPlan")`) {
+		t.Error("children pushed in EXPLAIN order")
+	}
+
+	sampler := Stap(&Script{Binary: "/bin/postgres", Sampler: testSampler(256, 256, 512)})
+	contains(t, "sampler", sampler,
+		`printf("{\"pid\":%d,\"event\":\"GetInstrument\",\"payload\":{%s}}\n", pid(), sprintf("\"plannode\":\"%p\",\"running\":\"%p\",\"tuplecount\":\"%p\"", node, user_int8(user_long(node+24)+2), user_long(user_long(node+24)+48)))`,
+		"if (user_long(node+24) == 0) {",
+		"if (now - last_sample < 1000) {",
+		"if (user_long(long_arg(1)+88) != root) {",
+		`printf("{\"pid\":%d,\"event\":\"SessionEnd\"}\n", pid())`)
+	// the plan goes in the params, one module serves every plan
+	if Stap(&Script{Binary: "/bin/postgres", Sampler: testSampler(1024, 1024)}) != sampler {
+		t.Error("stap sampler depends on the plan")
+	}
+	params := testSampler(256, 256, 512).Params()
+	if params["root"] != "256" || params["nodes"] != "100,200" {
+		t.Errorf("params %v", params)
+	}
+	if !strings.Contains(script, "while (stack_top[lpid] > 0 && seq < 1000) {") {
+		t.Error("stap walk is not bounded")
+	}
+}
+
+// stap cuts strings beyond MAXSTRINGLEN, the nodes of the largest plan fit
+func TestSamplerMaxNodes(t *testing.T) {
+	nodes := []uint64{}
+	for i := 0; i < MaxNodes; i++ {
+		nodes = append(nodes, ^uint64(i))
+	}
+	params := testSampler(nodes[0], nodes...).Params()
+	if n := len(params["nodes"]); n >= MaxStringLen || strings.Count(params["nodes"], ",") != MaxNodes-1 {
+		t.Errorf("nodes param of %d bytes does not fit %d", n, MaxStringLen)
+	}
+	if script := Stap(&Script{Sampler: testSampler(nodes[0], nodes...)}); !strings.Contains(script, `global nodes = ""`) {
+		t.Error("stap sampler holds the plan")
+	}
+}
+
+// the params are only read with offsets for them
+func TestWalkWithoutParams(t *testing.T) {
+	walk := testWalk()
+	walk.Params = nil
+	if script := Stap(&Script{Walk: walk}); !strings.Contains(script, "function parse_params:string (elem:long) {\n    return \"\"\n}") {
+		t.Errorf("stap reads params\n%s", script)
+	}
+	if script := BPFTrace(&Script{Walk: walk}); strings.Contains(script, "setparam") || strings.Contains(script, "@elem") {
+		t.Errorf("bpftrace reads params\n%s", script)
+	}
+}
+
+func TestBPFTrace(t *testing.T) {
+	script := BPFTrace(&Script{Binary: "/bin/postgres", Walk: testWalk(), Events: []Event{{"StatementCancelHandler", "StatementCancelHandler"}}})
+	contains(t, "walk", script,
+		"uprobe:/bin/postgres:ExecutorRun\n{",
+		`$root = *(uint64 *)uptr(arg0 + 88);`,
+		`@relationships[1] = "InitPlan";`,
+		`$worker = *(int32 *)uaddr("ParallelWorkerNumber");`,
+		`printf("{\"pid\":%d,\"event\":\"GenerateNode\",\"payload\":{\"plantype\":\"%d\",\"plan\":\"0x%lx\",\"plan_rows\":\"0x%lx\",\"parent\":\"0x%lx\",\"relationship\":\"%s\",\"setparam\":\"%d\",\"setparams\":\"%d\",\"root\":\"0x%lx\",\"seq\":\"%d\",\"leader\":\"%d\",\"worker\":\"%d\"}}\n", pid, *(int32 *)uptr($node + 0), $node, *(uint64 *)uptr(*(uint64 *)uptr($node + 8) + 24), $parent, @relationships[$r], $setparam, $setparams, $root, $seq, $leader, $worker);`,
+		`$params = *(uint64 *)uptr(*(uint64 *)uptr($elem + 8) + 56);`,
+		`$setparam = *(int32 *)uptr(*(uint64 *)uptr($params + 8) + 0);`,
+		`@elem[pid, $top] = $item;`,
+		"clear(@elem);",
+		"if ($tag == 58) {",
+		`@rel[pid, $top] = 2;`,
+		`printf("{\"pid\":%d,\"event\":\"PlanReady\",\"payload\":{\"nodes\":\"%d\"}}\n", pid, $seq);`,
+		"uprobe:/bin/postgres:StatementCancelHandler\n{\n"+`    printf("{\"pid\":%d,\"event\":\"StatementCancelHandler\"}\n", pid);`+"\n}",
+		"clear(@cells);")
+
+	sampler := BPFTrace(&Script{Binary: "/bin/postgres", Sampler: testSampler(256, 256, 512)})
+	contains(t, "sampler", sampler,
+		"/nsecs - @last_sample >= 1000000000/",
+		"if (*(uint64 *)uptr(512 + 24) != 0) {",
+		`printf("{\"pid\":%d,\"event\":\"GetInstrument\",\"payload\":{\"plannode\":\"0x%lx\",\"running\":\"0x%x\",\"tuplecount\":\"0x%lx\"}}\n", pid, 256, *(uint8 *)uptr(*(uint64 *)uptr(256 + 24) + 2), *(uint64 *)uptr(*(uint64 *)uptr(256 + 24) + 48));`,
+		"/*(uint64 *)uptr(arg0 + 88) == 256/",
+		`printf("{\"pid\":%d,\"event\":\"SessionEnd\"}\n", pid);`,
+		"clear(@last_sample);")
+}
+
+// the payload goes in json, a value may hold the separators of the old lines
+func TestParseLine(t *testing.T) {
+	format := lineFormat("GenerateNode", member("relationship", "%s")+","+member("plan", "0x%x"))
+	line := fmt.Sprintf(strings.Replace(format, `\n`, "", 1), 42, "Outer|Inner,k:v", 255)
+	l, err := ParseLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Pid != 42 || l.Event != "GenerateNode" || l.Payload["relationship"] != "Outer|Inner,k:v" || l.Payload["plan"] != "0xff" {
+		t.Errorf("parsed %+v", l)
+	}
+	for _, line := range []string{"42|GenerateNode|plan:0xff", `{"pid":42}`, `{"pid":42,"event":"GenerateNode"`} {
+		if _, err := ParseLine(line); err == nil {
+			t.Errorf("parsed %s", line)
+		}
+	}
+}
+
+// a field with tags is read from the nodes of its tags only
+func TestTaggedField(t *testing.T) {
+	walk := testWalk()
+	walk.Fields = append(walk.Fields, Field{Name: "num_workers", Type: Int, Path: []int{8, 104}, Tags: []int{89, 90}})
+	contains(t, "stap", Stap(&Script{Walk: walk}),
+		"    tag = user_int(node)\n    num_workers = 0\n    if (tag == 89 || tag == 90) {\n        num_workers = user_int(user_long(node+8)+104)\n    }\n",
+		`,\"num_workers\":\"%d\"", user_int(node+0), node, user_long(user_long(node+8)+24), num_workers)`)
+	contains(t, "bpftrace", BPFTrace(&Script{Walk: walk}),
+		"        $num_workers = 0;\n        if ($tag == 89 || $tag == 90) {\n            $num_workers = *(int32 *)uptr(*(uint64 *)uptr($node + 8) + 104);\n        }\n",
+		`,\"num_workers\":\"%d\",\"parent\"`,
+		"*(uint64 *)uptr(*(uint64 *)uptr($node + 8) + 24), $num_workers, $parent")
+}
@@ -0,0 +1,324 @@
+package probe
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// stapFormat is the printf conversion of the type
+func (t Type) stapFormat() string {
+	if t == Int {
+		return "%d"
+	}
+	return "%p"
+}
+
+func (t Type) stapRead() string {
+	switch t {
+	case Int:
+		return "user_int"
+	case Int8:
+		return "user_int8"
+	}
+	return "user_long"
+}
+
+// stapExpr reads the field from the base pointer expression
+func (f Field) stapExpr(base string) string {
+	if len(f.Path) == 0 {
+		return base
+	}
+	expr := base
+	for _, offset := range f.Path[:len(f.Path)-1] {
+		expr = fmt.Sprintf("user_long(%s+%d)", expr, offset)
+	}
+	return fmt.Sprintf("%s(%s+%d)", f.Type.stapRead(), expr, f.Path[len(f.Path)-1])
+}
+
+// stapSprintf formats the fields as the members of the payload, fields with
+// tags are read into the local of their name by stapTagged
+func stapSprintf(fields []Field, base string) string {
+	formats, args := []string{}, []string{}
+	for _, f := range fields {
+		formats = append(formats, member(f.Name, f.Type.stapFormat()))
+		if len(f.Tags) > 0 {
+			args = append(args, f.Name)
+		} else {
+			args = append(args, f.stapExpr(base))
+		}
+	}
+	return fmt.Sprintf("sprintf(%s, %s)", literal(strings.Join(formats, ",")), strings.Join(args, ", "))
+}
+
+// stapPrint prints a Line of event with the payload string expression, an
+// empty one prints no payload
+func stapPrint(pid string, event string, payload string) string {
+	if payload == "" {
+		return fmt.Sprintf("printf(%s, %s)", literal(lineFormat(event, "")), pid)
+	}
+	return fmt.Sprintf("printf(%s, %s, %s)", literal(lineFormat(event, "%s")), pid, payload)
+}
+
+func stapProbe(buf *bytes.Buffer, binary string, function string) {
+	fmt.Fprintf(buf, "probe process(\"%s\").function(\"%s\").call\n", binary, function)
+}
+
+// Stap renders the script for SystemTap. The sampler reads its plan from the
+// root and nodes module parameters, the rendering is the same for all plans.
+func Stap(s *Script) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("#!/usr/bin/env stap\n// generated by postTap from its probe definitions\n")
+	if s.Walk != nil {
+		stapWalk(buf, s.Binary, s.Walk)
+	}
+	if s.Sampler != nil {
+		stapSampler(buf, s.Binary, s.Sampler)
+	}
+	for _, e := range s.Events {
+		buf.WriteString("\n")
+		stapProbe(buf, s.Binary, e.Function)
+		fmt.Fprintf(buf, "{\n    %s\n}\n", stapPrint("pid()", e.Name, ""))
+	}
+	return buf.String()
+}
+
+const stapWalkHelpers = `
+global map_node, map_parent, map_relationship, map_elem, stack_top, list_cells
+
+// elem is the List element holding a child of a List, 0 for other nodes
+function push_node(lpid:long, node:long, parent:long, relationship:string, elem:long) {
+    if (node == 0) {
+        return 0
+    }
+    top = stack_top[lpid]++
+    map_node[lpid, top] = node
+    map_parent[lpid, top] = parent
+    map_relationship[lpid, top] = relationship
+    map_elem[lpid, top] = elem
+}
+
+// push an array of PlanState pointers backwards so the first one is printed first
+function push_array(lpid:long, plans:long, nplans:long, parent:long, relationship:string) {
+    for (i = nplans - 1; i >= 0; i--) {
+        push_node(lpid, user_long(plans + 8 * i), parent, relationship, 0)
+    }
+}
+
+// push the plan states at elem of the nodes of a List, backwards like push_array
+function push_list(lpid:long, list:long, length:long, head:long, next:long, elements:long, elem:long, parent:long, relationship:string) {
+    if (list == 0) {
+        return 0
+    }
+    n = user_int(list+length)
+    if (elements != 0) {
+        array = user_long(list+elements)
+        for (i = 0; i < n; i++) {
+            list_cells[lpid, i] = user_long(array + 8 * i)
+        }
+    } else {
+        cell = user_long(list+head)
+        for (i = 0; i < n && cell != 0; i++) {
+            list_cells[lpid, i] = user_long(cell)
+            cell = user_long(cell+next)
+        }
+        n = i
+    }
+    for (i = n - 1; i >= 0; i--) {
+        push_node(lpid, user_long(list_cells[lpid, i]+elem), parent, relationship, list_cells[lpid, i])
+        delete list_cells[lpid, i]
+    }
+}
+
+// children beyond lefttree and righttree name their parent
+function parse_parent:string (parent:long, relationship:string) {
+    if (parent == 0) {
+        return ""
+    }
+    return sprintf(",\"parent\":\"%p\",\"relationship\":\"%s\"", parent, relationship)
+}
+`
+
+// stapTagged reads the fields with tags of the node into locals, 0 for the
+// nodes of other tags
+func stapTagged(buf *bytes.Buffer, fields []Field) {
+	read := false
+	for _, f := range fields {
+		if len(f.Tags) == 0 {
+			continue
+		}
+		if !read {
+			buf.WriteString("    tag = user_int(node)\n")
+			read = true
+		}
+		fmt.Fprintf(buf, "    %s = 0\n    if (%s) {\n        %s = %s\n    }\n", f.Name, tagCond("tag", f.Tags), f.Name, f.stapExpr("node"))
+	}
+}
+
+func stapWalk(buf *bytes.Buffer, binary string, w *PlanWalk) {
+	buf.WriteString(stapWalkHelpers)
+	buf.WriteString("\nfunction parse_node:string (node:long) {\n")
+	stapTagged(buf, w.Fields)
+	fmt.Fprintf(buf, "    return %s\n}\n", stapSprintf(w.Fields, "node"))
+	buf.WriteString("\n// parallel workers name their leader backend\nfunction parse_worker:string () {\n")
+	if w.Parallel == nil {
+		buf.WriteString("    return \"\"\n}\n")
+	} else {
+		fmt.Fprintf(buf, "    worker = @var(\"%s@%s\")\n", w.Parallel.Worker, w.Parallel.File)
+		buf.WriteString("    if (worker < 0) {\n        return \"\"\n    }\n")
+		fmt.Fprintf(buf, "    return sprintf(%s, @var(\"%s@%s\"), worker)\n}\n", literal(","+member("leader", "%d")+","+member("worker", "%d")), w.Parallel.Leader, w.Parallel.File)
+	}
+	stapParams(buf, w.Params)
+
+	buf.WriteString("\n")
+	stapProbe(buf, binary, w.Function)
+	fmt.Fprintf(buf, `{
+    lpid = pid()
+    planstate_root = user_long(long_arg(1)+%d)
+    seq = 0
+    worker = parse_worker()
+    stack_top[lpid] = 0
+    push_node(lpid, planstate_root, 0, "", 0)
+    // larger plans are cut like bpftrace does, the sampler takes MaxNodes
+    while (stack_top[lpid] > 0 && seq < %d) {
+        top = --stack_top[lpid]
+        node = map_node[lpid, top]
+        parent = map_parent[lpid, top]
+        relationship = map_relationship[lpid, top]
+        elem = map_elem[lpid, top]
+        delete map_node[lpid, top]
+        delete map_parent[lpid, top]
+        delete map_relationship[lpid, top]
+        delete map_elem[lpid, top]
+        %s
+
+        // pushed in reverse of the EXPLAIN order
+        tag = user_int(node)
+`, w.RootOffset, MaxNodes, stapPrint("lpid", w.Event, "parse_node(node) . parse_parent(parent, relationship) . parse_params(elem) . sprintf("+
+		literal(","+member("root", "%p")+","+member("seq", "%d"))+", planstate_root, seq++) . worker"))
+	for i := len(w.Children) - 1; i >= 0; i-- {
+		stapPushChild(buf, w.Children[i])
+	}
+	fmt.Fprintf(buf, `    }
+    // the nodes left of a cut plan
+    while (stack_top[lpid] > 0) {
+        top = --stack_top[lpid]
+        delete map_node[lpid, top]
+        delete map_parent[lpid, top]
+        delete map_relationship[lpid, top]
+        delete map_elem[lpid, top]
+    }
+    delete stack_top[lpid]
+    // shield starts sampling once it has all nodes
+    %s
+}
+`, stapPrint("lpid", w.Done, "sprintf("+literal(member("nodes", "%d"))+", seq)"))
+}
+
+// stapParams renders parse_params, it prints nothing without Params
+func stapParams(buf *bytes.Buffer, p *Params) {
+	buf.WriteString("\n// the params an init plan returns, elem is its SubPlanState\nfunction parse_params:string (elem:long) {\n")
+	if p == nil {
+		buf.WriteString("    return \"\"\n}\n")
+		return
+	}
+	first := p.List.Head
+	if p.List.Elements != 0 {
+		first = p.List.Elements
+	}
+	fmt.Fprintf(buf, `    if (elem == 0) {
+        return ""
+    }
+    params = user_long(user_long(elem+%d)+%d)
+    if (params == 0) {
+        return ""
+    }
+    return sprintf(%s, user_int(user_long(params+%d)), user_int(params+%d))
+}
+`, p.SubPlan, p.SetParam, literal(","+member("setparam", "%d")+","+member("setparams", "%d")), first, p.List.Length)
+}
+
+func stapPushChild(buf *bytes.Buffer, c Child) {
+	indent := "        "
+	if c.Tag != 0 {
+		fmt.Fprintf(buf, "%sif (tag == %d) {\n", indent, c.Tag)
+		indent += "    "
+	}
+	parent := "node"
+	if c.Relationship == "" {
+		parent = "0"
+	}
+	switch c.Kind {
+	case ChildPointer:
+		fmt.Fprintf(buf, "%spush_node(lpid, user_long(node+%d), %s, \"%s\", 0)\n", indent, c.Offset, parent, c.Relationship)
+	case ChildArray:
+		fmt.Fprintf(buf, "%spush_array(lpid, user_long(node+%d), user_int(node+%d), %s, \"%s\")\n", indent, c.Offset, c.Count, parent, c.Relationship)
+	case ChildList:
+		fmt.Fprintf(buf, "%spush_list(lpid, user_long(node+%d), %d, %d, %d, %d, %d, %s, \"%s\")\n", indent, c.Offset,
+			c.List.Length, c.List.Head, c.List.Next, c.List.Elements, c.Elem, parent, c.Relationship)
+	}
+	if c.Tag != 0 {
+		buf.WriteString("        }\n")
+	}
+}
+
+func stapSampler(buf *bytes.Buffer, binary string, s *Sampler) {
+	fmt.Fprintf(buf, `
+// root is the plan state the query starts at, nodes the hex addresses of
+// its plan nodes separated by commas
+global root = 0
+global nodes = ""
+
+global last_sample, plan_nodes, n_nodes
+
+function sample() {
+    for (i = 0; i < n_nodes; i++) {
+        node = plan_nodes[i]
+`)
+	indent := "        "
+	if s.Guard != 0 {
+		fmt.Fprintf(buf, "%sif (user_long(node+%d) == 0) {\n%s    continue\n%s}\n", indent, s.Guard, indent, indent)
+	}
+	fmt.Fprintf(buf, "%s%s\n", indent, stapPrint("pid()", s.Event, stapSprintf(s.Fields, "node")))
+	fmt.Fprintf(buf, `    }
+    %s
+}
+
+probe begin {
+    if (target() == 0) {
+        println("No PID specified.  Use -c or -x.  See man stap for more information.")
+        exit()
+    }
+    node = tokenize(nodes, ",")
+    while (node != "") {
+        plan_nodes[n_nodes++] = strtol(node, 16)
+        node = tokenize("", ",")
+    }
+}
+
+// the instrumentation is only readable from the backend, sample on the first
+// call after the interval passed
+`, stapPrint("pid()", s.Done, ""))
+	stapProbe(buf, binary, s.Function)
+	fmt.Fprintf(buf, `{
+    now = gettimeofday_ms()
+    if (now - last_sample < %d) {
+        next
+    }
+    last_sample = now
+    sample()
+}
+
+// the last sample, queries run by the query like functions do not end it
+`, int64(s.Interval.Nanoseconds()/1e6))
+	stapProbe(buf, binary, s.Finish)
+	fmt.Fprintf(buf, `{
+    if (user_long(long_arg(1)+%d) != root) {
+        next
+    }
+    sample()
+    %s
+    exit()
+}
+`, s.RootOffset, stapPrint("pid()", s.End, ""))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"postTap/shield/pg"
+)
+
+// QuerySummary is a query without its plan tree
+type QuerySummary struct {
+	Pid        int       `json:"id"`
+	Host       string    `json:"host,omitempty"`
+	QueryText  string    `json:"query_text,omitempty"`
+	Dbname     string    `json:"db"`
+	Username   string    `json:"username"`
+	Status     string    `json:"status"`
+	SubmitTime time.Time `json:"submit_time"`
+	StartTime  time.Time `json:"start_time"`
+	// Progress is the last estimate, nil before the first sample
+	Progress *pg.QueryProgress `json:"progress,omitempty"`
+}
+
+func (qi *QueryInfo) Summary() *QuerySummary {
+	qi.rwlock.RLock()
+	defer qi.rwlock.RUnlock()
+	return &QuerySummary{qi.Pid, qi.Host, qi.QueryText, qi.Dbname, qi.Username, qi.Status, qi.SubmitTime, qi.StartTime, qi.Progress}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeRawJSON(w, code, bytes)
+}
+
+func writeRawJSON(w http.ResponseWriter, code int, bytes []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bytes)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	bytes, _ := json.Marshal(map[string]string{"error": msg})
+	writeRawJSON(w, code, bytes)
+}
+
+// serveQueries handles GET /api/queries, the list of live queries
+func serveQueries(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/queries" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	result := []*QuerySummary{}
+	for _, qi := range qs.ListQueries() {
+		result = append(result, qi.Summary())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SubmitTime.Before(result[j].SubmitTime)
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// renderExplain renders the plan like EXPLAIN ANALYZE, ?format=text picks the
+// text format and ?buffers= overrides whether buffer usage is shown. It
+// returns the content type and body, or the status code of the error.
+func renderExplain(r *http.Request, plan *pg.PlanStateWrapper, start time.Time, end time.Time) (string, []byte, int, error) {
+	if plan == nil {
+		return "", nil, http.StatusNotFound, fmt.Errorf("No plan yet")
+	}
+	params := r.URL.Query()
+	opts := pg.ExplainOptions{Buffers: qs.conf != nil && qs.conf.InstrumentBuffers}
+	if s := params.Get("buffers"); s != "" {
+		var err error
+		if opts.Buffers, err = strconv.ParseBool(s); err != nil {
+			return "", nil, http.StatusBadRequest, fmt.Errorf("Invalid buffers")
+		}
+	}
+	if !start.IsZero() && end.After(start) {
+		opts.ExecutionTime = end.Sub(start)
+	}
+	switch params.Get("format") {
+	case "", "json":
+		bytes, err := pg.ExplainJSON(plan, opts)
+		if err != nil {
+			return "", nil, http.StatusInternalServerError, err
+		}
+		return "application/json", bytes, http.StatusOK, nil
+	case "text":
+		return "text/plain; charset=utf-8", []byte(pg.ExplainText(plan, opts)), http.StatusOK, nil
+	}
+	return "", nil, http.StatusBadRequest, fmt.Errorf("Invalid format")
+}
+
+// writeExplain writes what renderExplain returned
+func writeExplain(w http.ResponseWriter, contentType string, bytes []byte, code int, err error) {
+	if err != nil {
+		writeError(w, code, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	w.Write(bytes)
+}
+
+// serveQuery handles /api/queries/{pid}[/plan|/explain|/sample], the host query
+// parameter picks the agent when the pid is not unique. POST /sample starts
+// the sampling session of a query whose session did not start, it answers 409
+// while the session runs, the session samples every sample_interval by itself.
+func serveQuery(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/queries/"), "/"), "/")
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	host := r.URL.Query().Get("host")
+	key, live := qs.ResolveKey(host, pid)
+
+	switch action {
+	case "", "plan":
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if qi, ok := qs.GetQuery(key); live && ok {
+			var bytes []byte
+			var err error
+			if action == "plan" {
+				bytes, err = qi.GetPlanTreeJSON()
+			} else {
+				bytes, err = qi.GetPlanJSON()
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeRawJSON(w, http.StatusOK, bytes)
+			return
+		}
+		rec := findHistory(host, pid)
+		if rec == nil {
+			writeError(w, http.StatusNotFound, "Query not found")
+			return
+		}
+		if action == "plan" {
+			writeJSON(w, http.StatusOK, rec.Plan)
+		} else {
+			writeJSON(w, http.StatusOK, rec)
+		}
+	case "explain":
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if qi, ok := qs.GetQuery(key); live && ok {
+			// a slow client must not hold up the probe updates of the query
+			qi.rwlock.RLock()
+			contentType, bytes, code, err := renderExplain(r, qi.PlanStateRoot, qi.StartTime, qi.EndTime)
+			qi.rwlock.RUnlock()
+			writeExplain(w, contentType, bytes, code, err)
+			return
+		}
+		rec := findHistory(host, pid)
+		if rec == nil {
+			writeError(w, http.StatusNotFound, "Query not found")
+			return
+		}
+		contentType, bytes, code, err := renderExplain(r, rec.Plan, rec.StartTime, rec.EndTime)
+		writeExplain(w, contentType, bytes, code, err)
+	case "sample":
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		qi, ok := qs.GetQuery(key)
+		if !live || !ok {
+			writeError(w, http.StatusNotFound, "Query not found")
+			return
+		}
+		if err := qi.StartSampling(); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "sampling"})
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// serveHistory handles GET /api/history?host=&pid=&limit=
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if qs.history == nil {
+		writeError(w, http.StatusNotFound, "History is disabled")
+		return
+	}
+	params := r.URL.Query()
+	limit := 100
+	if s := params.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+	pid := 0
+	if s := params.Get("pid"); s != "" {
+		var err error
+		if pid, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid pid")
+			return
+		}
+	}
+	host := params.Get("host")
+	records, err := qs.history.Find(func(rec *HistoryRecord) bool {
+		return (host == "" || rec.Host == host) && (pid == 0 || rec.Pid == pid)
+	}, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// findHistory returns the latest finished query of the pid
+func findHistory(host string, pid int) *HistoryRecord {
+	if qs.history == nil {
+		return nil
+	}
+	records, err := qs.history.Find(func(rec *HistoryRecord) bool {
+		return rec.Pid == pid && (host == "" || rec.Host == host)
+	}, 1)
+	if err != nil || len(records) == 0 {
+		return nil
+	}
+	return records[0]
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"postTap/shield/pg"
+)
+
+func TestServeQueryAPI(t *testing.T) {
+	qs = &QueryMsgProcessor{Queries: map[QueryKey]*QueryInfo{}}
+	qs.Queries[QueryKey{"seg1", 42}] = &QueryInfo{Pid: 42, Host: "seg1", Status: "start",
+		PlanStateRoot: &pg.PlanStateWrapper{NodeTypeString: "Seq Scan"}}
+
+	rec := httptest.NewRecorder()
+	serveQueries(rec, httptest.NewRequest("GET", "/api/queries", nil))
+	var list []QuerySummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].Host != "seg1" {
+		t.Fatalf("unexpected list %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/42/plan", nil))
+	var plan map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &plan); err != nil || plan["Node Type"] != "Seq Scan" {
+		t.Fatalf("unexpected plan %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/42/explain", nil))
+	var explain []struct{ Plan map[string]interface{} }
+	if err := json.Unmarshal(rec.Body.Bytes(), &explain); err != nil || len(explain) != 1 || explain[0].Plan["Node Type"] != "Seq Scan" {
+		t.Fatalf("unexpected explain %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/42/explain?format=text", nil))
+	if rec.Body.String() != "Seq Scan  (cost=0.00..0.00 rows=0 width=0) (never executed)\n" {
+		t.Errorf("unexpected text explain %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/7", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown pid, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/42/sample", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET sample, got %d", rec.Code)
+	}
+
+	// the running session takes no samples on demand
+	qs.Queries[QueryKey{"seg1", 42}].sampling = true
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("POST", "/api/queries/42/sample", nil))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "sampled already") {
+		t.Errorf("expected 409 while sampling, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// blockingWriter holds the handler in Write until it is released
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan bool
+	release chan bool
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	w.writing <- true
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestServeQueryErrors(t *testing.T) {
+	qi := &QueryInfo{Pid: 42, Host: "seg1", Status: "start",
+		PlanStateRoot: &pg.PlanStateWrapper{NodeTypeString: "Seq Scan"}}
+	qs = &QueryMsgProcessor{Queries: map[QueryKey]*QueryInfo{{"seg1", 42}: qi}}
+
+	// a slow client of explain does not block the probe updates
+	w := &blockingWriter{httptest.NewRecorder(), make(chan bool), make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		serveQuery(w, httptest.NewRequest("GET", "/api/queries/42/explain", nil))
+		done <- true
+	}()
+	<-w.writing
+	locked := make(chan bool)
+	go func() {
+		qi.rwlock.Lock()
+		qi.rwlock.Unlock()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Error("explain holds the query lock while writing")
+	}
+	close(w.release)
+	<-done
+
+	rec := httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/42/explain?format=yaml", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+
+	// json can not encode NaN, the server answers instead of exiting
+	qi.PlanStateRoot.PlanRows = math.NaN()
+	rec = httptest.NewRecorder()
+	serveQuery(rec, httptest.NewRequest("GET", "/api/queries/42/plan", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for an unencodable plan, got %d", rec.Code)
+	}
+}
+
+// a bad websocket subscription is answered before the upgrade
+func TestServeWsErrors(t *testing.T) {
+	qs = &QueryMsgProcessor{Queries: map[QueryKey]*QueryInfo{}}
+	for url, code := range map[string]int{"/ws?pid=abc": http.StatusBadRequest, "/ws?pid=42&host=seg1": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		serveWs(newHub(), rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != code || !strings.Contains(rec.Body.String(), "error") {
+			t.Errorf("%s: %d %s", url, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -38,24 +38,40 @@ var upgrader = websocket.Upgrader{
 }
 
 // serveWs handles websocket requests from the peer.
+// The pid, host, db and user query parameters set the initial subscription,
+// without any of them the client receives every query.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	spid := r.URL.Query().Get("pid")
-	ipid := 0
-	var err error
-	if spid != "" {
-		ipid, err = strconv.Atoi(spid)
+	params := r.URL.Query()
+	sub := NewSubscription()
+	if spid := params.Get("pid"); spid != "" {
+		ipid, err := strconv.Atoi(spid)
 		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid pid")
 			return
 		}
-		if !qs.IsQueryExist(ipid) {
+		key, ok := qs.ResolveKey(params.Get("host"), ipid)
+		if !ok {
+			writeError(w, http.StatusNotFound, "Query not found")
 			return
 		}
+		sub.Queries[key] = true
 	}
+	if db := params.Get("db"); db != "" {
+		sub.Dbnames[db] = true
+	}
+	if user := params.Get("user"); user != "" {
+		sub.Users[user] = true
+	}
+	sub.All = len(sub.Queries) == 0 && len(sub.Dbnames) == 0 && len(sub.Users) == 0
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &WebSocketClient{hub: hub, conn: conn}
-	client.hub.register <- client
+	client := NewWebSocketClient(hub, conn, conf.WSSendQueue)
+	client.hub.register <- &registration{client, sub}
+
+	go client.writePump()
+	go client.readPump()
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"postTap/shield/pg"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryRecord is a finished or cancelled query as kept in the history store
+type HistoryRecord struct {
+	Pid        int                  `json:"id"`
+	Host       string               `json:"host,omitempty"`
+	QueryText  string               `json:"query_text,omitempty"`
+	Dbname     string               `json:"db"`
+	Username   string               `json:"username"`
+	Status     string               `json:"status"`
+	SubmitTime time.Time            `json:"submit_time"`
+	StartTime  time.Time            `json:"start_time"`
+	EndTime    time.Time            `json:"end_time"`
+	Plan       *pg.PlanStateWrapper `json:"plan,omitempty"`
+	// Misestimates are the plan nodes flagged while the query ran
+	Misestimates []*pg.Misestimate `json:"misestimates,omitempty"`
+}
+
+// NewHistoryRecord snapshots the query. The plan is copied through json, the
+// nodes of the live query are still updated by late probes.
+func NewHistoryRecord(qi *QueryInfo) (*HistoryRecord, error) {
+	qi.rwlock.RLock()
+	defer qi.rwlock.RUnlock()
+	rec := &HistoryRecord{
+		Pid:          qi.Pid,
+		Host:         qi.Host,
+		QueryText:    qi.QueryText,
+		Dbname:       qi.Dbname,
+		Username:     qi.Username,
+		Status:       qi.Status,
+		SubmitTime:   qi.SubmitTime,
+		StartTime:    qi.StartTime,
+		EndTime:      qi.EndTime,
+		Misestimates: append([]*pg.Misestimate{}, qi.Misestimates...),
+	}
+	if qi.PlanStateRoot != nil {
+		bytes, err := json.Marshal(qi.PlanStateRoot)
+		if err != nil {
+			return nil, err
+		}
+		rec.Plan = new(pg.PlanStateWrapper)
+		if err := json.Unmarshal(bytes, rec.Plan); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// HistoryStore keeps one json file per finished query in a directory.
+// File names start with the end time so a sorted listing is chronological.
+type HistoryStore struct {
+	dir        string
+	maxEntries int
+	maxAge     time.Duration
+	lock       sync.Mutex
+}
+
+// NewHistoryStore opens the store, maxEntries or maxAge of 0 means no limit
+func NewHistoryStore(dir string, maxEntries int, maxAge time.Duration) (*HistoryStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &HistoryStore{dir: dir, maxEntries: maxEntries, maxAge: maxAge}, nil
+}
+
+func historyFileName(rec *HistoryRecord) string {
+	host := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, rec.Host)
+	return fmt.Sprintf("%s_%s_%d.json", timePrefix(rec.EndTime), host, rec.Pid)
+}
+
+// timePrefix is padded so the file names sort by time
+func timePrefix(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// Save writes the record and applies the retention limits
+func (hs *HistoryStore) Save(rec *HistoryRecord) error {
+	bytes, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if err := ioutil.WriteFile(filepath.Join(hs.dir, historyFileName(rec)), bytes, 0644); err != nil {
+		return err
+	}
+	return hs.prune()
+}
+
+// files returns the record files, oldest first
+func (hs *HistoryStore) files() ([]string, error) {
+	infos, err := ioutil.ReadDir(hs.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (hs *HistoryStore) prune() error {
+	names, err := hs.files()
+	if err != nil {
+		return err
+	}
+	expired := 0
+	if hs.maxEntries > 0 && len(names) > hs.maxEntries {
+		expired = len(names) - hs.maxEntries
+	}
+	if hs.maxAge > 0 {
+		oldest := timePrefix(time.Now().Add(-hs.maxAge))
+		for expired < len(names) && names[expired] < oldest {
+			expired++
+		}
+	}
+	for _, name := range names[:expired] {
+		if err := os.Remove(filepath.Join(hs.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs *HistoryStore) load(name string) (*HistoryRecord, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(hs.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	rec := new(HistoryRecord)
+	if err := json.Unmarshal(bytes, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Find returns the records matching filter, newest first.
+// A nil filter matches everything, limit of 0 means no limit.
+func (hs *HistoryStore) Find(filter func(*HistoryRecord) bool, limit int) ([]*HistoryRecord, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	names, err := hs.files()
+	if err != nil {
+		return nil, err
+	}
+	result := []*HistoryRecord{}
+	for i := len(names) - 1; i >= 0; i-- {
+		rec, err := hs.load(names[i])
+		if err != nil {
+			log.Printf("Skip broken history record %s: %s", names[i], err)
+			continue
+		}
+		if filter == nil || filter(rec) {
+			result = append(result, rec)
+			if limit > 0 && len(result) == limit {
+				break
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHistoryStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posttap-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hs, err := NewHistoryStore(dir, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	records := []*HistoryRecord{
+		{Pid: 1, Host: "seg/1", EndTime: now.Add(-2 * time.Hour)},
+		{Pid: 2, Host: "seg1", EndTime: now.Add(-time.Minute)},
+		{Pid: 3, Host: "seg1", EndTime: now.Add(-30 * time.Second)},
+		{Pid: 4, Host: "seg2", EndTime: now},
+	}
+	for _, rec := range records {
+		if err := hs.Save(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := hs.Find(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Pid != 4 || all[1].Pid != 3 {
+		t.Fatalf("unexpected records after retention: %+v", all)
+	}
+	found, _ := hs.Find(func(rec *HistoryRecord) bool { return rec.Host == "seg1" }, 1)
+	if len(found) != 1 || found[0].Pid != 3 {
+		t.Errorf("filter mismatch: %+v", found)
+	}
+}
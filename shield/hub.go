@@ -4,49 +4,106 @@
 
 package main
 
-import "github.com/gorilla/websocket"
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 type IClient interface {
-	WriteTextMessage([]byte) error
+	// Enqueue queues msg without blocking, false means the queue is full.
+	Enqueue([]byte) bool
+	// Close stops the client, the hub calls it once when the client leaves.
+	Close()
+}
+
+// Policies for clients whose send queue is full
+const (
+	dropSlowClient       = "drop"
+	disconnectSlowClient = "disconnect"
+)
+
+// HubMessage is a broadcast message with the query it is about
+type HubMessage struct {
+	Key      QueryKey
+	Dbname   string
+	Username string
+	Data     []byte
+}
+
+type registration struct {
+	client IClient
+	sub    *Subscription
+}
+
+type subscribeRequest struct {
+	client IClient
+	msg    *SubscribeMsg
 }
 
 // hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Registered clients.
-	clients map[IClient]bool
+	// Registered clients and what they subscribed to.
+	clients map[IClient]*Subscription
 
 	// Inbound messages from the clients.
-	broadcast chan []byte
+	broadcast chan *HubMessage
 
 	// Register requests from the clients.
-	register chan IClient
+	register chan *registration
 
 	// Unregister requests from clients.
 	unregister chan IClient
+
+	// Subscribe and unsubscribe requests from clients.
+	subscribe chan *subscribeRequest
+
+	// What to do with a client that can not keep up, drop the message or
+	// disconnect the client.
+	slowClientPolicy string
 }
 
 func newHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan IClient),
+		broadcast:  make(chan *HubMessage),
+		register:   make(chan *registration),
 		unregister: make(chan IClient),
-		clients:    make(map[IClient]bool),
+		subscribe:  make(chan *subscribeRequest),
+		clients:    make(map[IClient]*Subscription),
+
+		slowClientPolicy: dropSlowClient,
 	}
 }
 
 func (h *Hub) Run() {
 	for {
 		select {
-		case client := <-h.register:
-			h.clients[client] = true
+		case reg := <-h.register:
+			h.clients[reg.client] = reg.sub
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
+				client.Close()
+			}
+		case req := <-h.subscribe:
+			if sub, ok := h.clients[req.client]; ok {
+				if err := sub.Apply(req.msg); err != nil {
+					log.Println(err)
+				}
 			}
 		case plan := <-h.broadcast:
-			for client := range h.clients {
-				client.WriteTextMessage(plan)
+			for client, sub := range h.clients {
+				if !sub.Match(plan) || client.Enqueue(plan.Data) {
+					continue
+				}
+				if h.slowClientPolicy == disconnectSlowClient {
+					log.Println("Disconnect slow websocket client")
+					delete(h.clients, client)
+					client.Close()
+				}
 			}
 		}
 	}
@@ -61,9 +118,84 @@ type WebSocketClient struct {
 	Send chan []byte
 }
 
-func NewWebSocketClient(hub *Hub, conn *websocket.Conn) *WebSocketClient {
-	return &WebSocketClient{hub: hub, conn: conn, Send: make(chan []byte)}
+func NewWebSocketClient(hub *Hub, conn *websocket.Conn, queueSize int) *WebSocketClient {
+	return &WebSocketClient{hub: hub, conn: conn, Send: make(chan []byte, queueSize)}
+}
+
+func (wsclient *WebSocketClient) Enqueue(msg []byte) bool {
+	select {
+	case wsclient.Send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (wsclient *WebSocketClient) Close() {
+	close(wsclient.Send)
+}
+
+// readPump handles subscribe and unsubscribe messages from the peer.
+//
+// The application runs readPump in a per-connection goroutine. It ensures
+// there is at most one reader on a connection and unregisters the client
+// when the connection fails.
+func (wsclient *WebSocketClient) readPump() {
+	defer func() {
+		wsclient.hub.unregister <- wsclient
+		wsclient.conn.Close()
+	}()
+	wsclient.conn.SetReadLimit(maxMessageSize)
+	wsclient.conn.SetReadDeadline(time.Now().Add(pongWait))
+	wsclient.conn.SetPongHandler(func(string) error {
+		wsclient.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, message, err := wsclient.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+				log.Printf("error: %v", err)
+			}
+			return
+		}
+		msg := new(SubscribeMsg)
+		if err := json.Unmarshal(message, msg); err != nil {
+			log.Printf("Invalid subscription message: %s", message)
+			continue
+		}
+		wsclient.hub.subscribe <- &subscribeRequest{wsclient, msg}
+	}
 }
-func (wsclient *WebSocketClient) WriteTextMessage(msg []byte) error {
-	return wsclient.conn.WriteMessage(websocket.TextMessage, msg)
+
+// writePump pumps messages from the send queue to the websocket connection.
+//
+// A goroutine running writePump is started for each connection. It ensures
+// there is at most one writer on a connection and keeps the peer alive with
+// pings.
+func (wsclient *WebSocketClient) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		wsclient.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-wsclient.Send:
+			wsclient.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel.
+				wsclient.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := wsclient.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			wsclient.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := wsclient.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				return
+			}
+		}
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+type fakeClient struct {
+	received [][]byte
+	capacity int
+	closed   bool
+}
+
+func newFakeClient(capacity int) *fakeClient {
+	return &fakeClient{capacity: capacity}
+}
+
+func (c *fakeClient) Enqueue(msg []byte) bool {
+	if len(c.received) >= c.capacity {
+		return false
+	}
+	c.received = append(c.received, msg)
+	return true
+}
+
+func (c *fakeClient) Close() {
+	c.closed = true
+}
+
+func TestHubSubscriptions(t *testing.T) {
+	h := newHub()
+	go h.Run()
+
+	all, one, db := newFakeClient(10), newFakeClient(10), newFakeClient(10)
+	allSub := NewSubscription()
+	allSub.All = true
+	h.register <- &registration{all, allSub}
+	h.register <- &registration{one, NewSubscription()}
+	h.register <- &registration{db, NewSubscription()}
+	h.subscribe <- &subscribeRequest{one, &SubscribeMsg{Action: "subscribe", Pid: 42}}
+	h.subscribe <- &subscribeRequest{db, &SubscribeMsg{Action: "subscribe", Db: "sales"}}
+
+	h.broadcast <- &HubMessage{Key: QueryKey{"seg1", 42}, Dbname: "postgres", Data: []byte("a")}
+	h.broadcast <- &HubMessage{Key: QueryKey{"seg1", 7}, Dbname: "sales", Data: []byte("b")}
+	h.subscribe <- &subscribeRequest{one, &SubscribeMsg{Action: "unsubscribe", Pid: 42}}
+	h.broadcast <- &HubMessage{Key: QueryKey{"seg2", 42}, Data: []byte("c")}
+	// the hub handles requests in order, these make sure "c" was delivered
+	// and all was closed
+	h.unregister <- all
+	h.unregister <- one
+
+	if len(all.received) != 3 || !all.closed {
+		t.Errorf("all subscriber got %d messages, closed %v", len(all.received), all.closed)
+	}
+	if len(one.received) != 1 || string(one.received[0]) != "a" {
+		t.Errorf("pid subscriber got %q", one.received)
+	}
+	if len(db.received) != 1 || string(db.received[0]) != "b" {
+		t.Errorf("db subscriber got %q", db.received)
+	}
+}
+
+func TestHubSlowClient(t *testing.T) {
+	for _, policy := range []string{dropSlowClient, disconnectSlowClient} {
+		h := newHub()
+		h.slowClientPolicy = policy
+		go h.Run()
+
+		slow, fast := newFakeClient(1), newFakeClient(10)
+		for _, c := range []*fakeClient{slow, fast} {
+			sub := NewSubscription()
+			sub.All = true
+			h.register <- &registration{c, sub}
+		}
+		for _, data := range []string{"a", "b", "c"} {
+			h.broadcast <- &HubMessage{Data: []byte(data)}
+		}
+		h.unregister <- fast
+
+		if len(fast.received) != 3 {
+			t.Errorf("%s: slow client stalled the fast one, got %d", policy, len(fast.received))
+		}
+		if slow.closed != (policy == disconnectSlowClient) {
+			t.Errorf("%s: slow client closed %v", policy, slow.closed)
+		}
+	}
+}
+
+// serveWs subscribes the host of the pid, unsubscribing the pid alone ends it
+func TestUnsubscribePid(t *testing.T) {
+	sub := NewSubscription()
+	sub.Apply(&SubscribeMsg{Action: "subscribe", Pid: 42, Host: "seg1"})
+	sub.Apply(&SubscribeMsg{Action: "subscribe", Pid: 42, Host: "seg2"})
+	sub.Apply(&SubscribeMsg{Action: "subscribe", Pid: 7, Host: "seg1"})
+	if err := sub.Apply(&SubscribeMsg{Action: "unsubscribe", Pid: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Match(&HubMessage{Key: QueryKey{"seg1", 42}}) || sub.Match(&HubMessage{Key: QueryKey{"seg2", 42}}) {
+		t.Errorf("pid still subscribed %v", sub.Queries)
+	}
+	if !sub.Match(&HubMessage{Key: QueryKey{"seg1", 7}}) {
+		t.Error("unsubscribe removed another pid")
+	}
+	sub.Apply(&SubscribeMsg{Action: "unsubscribe", Pid: 7, Host: "seg2"})
+	if !sub.Match(&HubMessage{Key: QueryKey{"seg1", 7}}) {
+		t.Error("unsubscribe removed another host")
+	}
+}
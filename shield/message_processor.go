@@ -4,86 +4,378 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
+	"postTap/communicator"
+	"postTap/config"
+	"postTap/pgprofile"
 	"postTap/shield/pg"
-
-	"strconv"
-	"strings"
 )
 
+// QueryKey identifies a backend, pids are only unique within one agent host
+type QueryKey struct {
+	Host string
+	Pid  int
+}
+
+func (key QueryKey) String() string {
+	if key.Host == "" {
+		return fmt.Sprintf("%d", key.Pid)
+	}
+	return fmt.Sprintf("%s:%d", key.Host, key.Pid)
+}
+
+// QueryMsgProcessor is the registry of running queries.
+//
+// Concurrency model: lock guards the Queries and Agents maps, each QueryInfo
+// guards its own fields with its rwlock. When both are needed lock is taken
+// first. Neither lock is held during I/O (database, history, hub, transport),
+// so probe processing, http handlers and session timers never wait on each
+// other's I/O.
 type QueryMsgProcessor struct {
 	backendDB *DBWrapper
-	Queries   map[int]*QueryInfo
+	Queries   map[QueryKey]*QueryInfo
 	Queryhub  *Hub
+	// Agents holds the last time each agent host was heard of
+	Agents map[string]time.Time
+	// profiles holds the layout profile each agent host registered with
+	profiles map[string]*pgprofile.Profile
+	lock     sync.RWMutex
+	comm     communicator.Communicator
+	conf     *config.Config
+	// history is nil when history is disabled
+	history   *HistoryStore
+	localHost string
 }
 type PlanMessage struct {
 	MessageType string
 	Query       *QueryInfo
 }
 
-func MakeQueryMsgProcessor(dbname string) *QueryMsgProcessor {
-	qs := new(QueryMsgProcessor)
+// MisestimateMessage tells websocket clients about a misestimated plan node
+type MisestimateMessage struct {
+	MessageType string
+	Host        string
+	Pid         int
+	Misestimate *pg.Misestimate
+}
+
+func MakeQueryMsgProcessor(conf *config.Config, comm communicator.Communicator) (*QueryMsgProcessor, error) {
+	qs := newQueryMsgProcessor(conf, comm)
 	qs.backendDB = new(DBWrapper)
-	qs.backendDB.Init("gpadmin", dbname)
-	qs.Queries = map[int]*QueryInfo{}
+	qs.backendDB.Init(conf.DBUser, conf.DBName)
+	if conf.HistoryDir != "" {
+		history, err := NewHistoryStore(conf.HistoryDir, conf.HistoryMaxEntries, conf.HistoryMaxAge.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create history_dir %s: %s", conf.HistoryDir, err)
+		}
+		qs.history = history
+	}
+	return qs, nil
+}
+
+// newQueryMsgProcessor creates a processor without database and history
+func newQueryMsgProcessor(conf *config.Config, comm communicator.Communicator) *QueryMsgProcessor {
+	qs := new(QueryMsgProcessor)
+	qs.comm = comm
+	qs.conf = conf
+	qs.localHost, _ = os.Hostname()
+	qs.Queries = map[QueryKey]*QueryInfo{}
+	qs.Agents = map[string]time.Time{}
+	qs.profiles = map[string]*pgprofile.Profile{}
 	return qs
 }
-func (qs *QueryMsgProcessor) DeleteQuery(pid int) {
-	delete(qs.Queries, pid)
+
+// removeQuery deletes q unless a newer query of the backend replaced it
+func (qs *QueryMsgProcessor) removeQuery(key QueryKey, q *QueryInfo) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	if qs.Queries[key] == q {
+		delete(qs.Queries, key)
+	}
 }
-func (qs *QueryMsgProcessor) UpdateStatus(pid int, stat int) {
-	if q, ok := qs.Queries[pid]; ok {
-		if q.statusCode < stat {
-			q.statusCode = stat
-			q.Status = GetStatusString(stat)
-			log.Println("query status:", q.Status)
-			q.StatusChanged(stat)
+
+// GetQuery returns the running query of key
+func (qs *QueryMsgProcessor) GetQuery(key QueryKey) (*QueryInfo, bool) {
+	qs.lock.RLock()
+	defer qs.lock.RUnlock()
+	qi, ok := qs.Queries[key]
+	return qi, ok
+}
+
+// ListQueries returns a snapshot of the running queries, parallel workers
+// are part of their leader
+func (qs *QueryMsgProcessor) ListQueries() []*QueryInfo {
+	qs.lock.RLock()
+	defer qs.lock.RUnlock()
+	result := make([]*QueryInfo, 0, len(qs.Queries))
+	for _, qi := range qs.Queries {
+		if qi.Leader() == nil {
+			result = append(result, qi)
 		}
-	} else {
-		qs.Queries[pid] = &QueryInfo{Pid: pid, statusCode: stat, Status: GetStatusString(stat), instruConfig: map[string]bool{"base": true, "accumulated": true, "buffer": false}}
 	}
-	if stat == finish || stat == cancel {
-		//qs.Queries[pid].PrintPlan()
-		qs.DeleteQuery(pid)
+	return result
+}
+
+// touchAgent records that the agent host is alive
+func (qs *QueryMsgProcessor) touchAgent(host string) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	qs.Agents[host] = time.Now()
+}
+
+// registerAgent records the layout profile the agent host runs with, the
+// profile data sent along wins over a profile of the same name known here
+func (qs *QueryMsgProcessor) registerAgent(host string, profileName string, profileData string) {
+	profile := new(pgprofile.Profile)
+	if profileData == "" || json.Unmarshal([]byte(profileData), profile) != nil {
+		var err error
+		if profile, err = pgprofile.GetProfile(profileName); err != nil {
+			log.Printf("agent %s: %s", host, err)
+			return
+		}
 	}
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	qs.profiles[host] = profile
+}
 
+// profileFor returns the layout profile of the agent host, callers hold lock
+func (qs *QueryMsgProcessor) profileFor(host string) *pgprofile.Profile {
+	if profile, ok := qs.profiles[host]; ok {
+		return profile
+	}
+	name := pgprofile.DefaultProfile
+	if qs.conf != nil && qs.conf.PGProfile != "" {
+		name = qs.conf.PGProfile
+	}
+	profile, err := pgprofile.GetProfile(name)
+	if err != nil {
+		profile, _ = pgprofile.GetProfile(pgprofile.DefaultProfile)
+	}
+	return profile
 }
 
-func (qs *QueryMsgProcessor) UpdateInstrument(pid int, instru string) {
-	if qi, ok := qs.Queries[pid]; ok {
-		qi.UpdateNode(instru)
+// getOrCreateQuery returns the query of key, creating it when it is new
+func (qs *QueryMsgProcessor) getOrCreateQuery(key QueryKey, stat int, now time.Time) (*QueryInfo, bool) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+	if q, ok := qs.Queries[key]; ok {
+		return q, false
 	}
+	q := &QueryInfo{Pid: key.Pid, Host: key.Host, statusCode: stat, Status: GetStatusString(stat), SubmitTime: now, instruConfig: map[string]bool{"base": true, "accumulated": true, "buffer": qs.conf != nil && qs.conf.InstrumentBuffers}, comm: qs.comm, conf: qs.conf, profile: qs.profileFor(key.Host)}
+	if stat == start {
+		q.StartTime = now
+	}
+	qs.Queries[key] = q
+	return q, true
 }
 
-func (qs *QueryMsgProcessor) Export(pid int) {
-	if qi, ok := qs.Queries[pid]; ok {
-		//queryComm.Send("publish", qi.GetPlanJSON())
+// sessionEndGrace is how long a finished query waits for the last sample of
+// its sampling session
+const sessionEndGrace = 5 * time.Second
 
-		result, err := json.Marshal(PlanMessage{"query", qi})
+func (qs *QueryMsgProcessor) UpdateStatus(key QueryKey, stat int) {
+	now := time.Now()
+	if stat == submit {
+		// the previous query of the backend may still wait for its last sample
+		if q, ok := qs.GetQuery(key); ok && q.status() == finish {
+			qs.finalize(key, q, now)
+		}
+	}
+	q, created := qs.getOrCreateQuery(key, stat, now)
+	if created {
+		if qs.isLocal(key.Host) {
+			if err := qs.GetQueryDetails(key); err != nil {
+				log.Printf("Failed to get details of query %s: %s", key, err)
+			}
+		}
+	} else if q.setStatus(stat, now) {
+		log.Println("query status:", GetStatusString(stat))
+		q.StatusChanged(stat)
+	}
+	switch {
+	case stat == cancel || (stat == finish && !q.sessionRunning()):
+		qs.finalize(key, q, now)
+	case stat == finish:
+		// the session sends SessionEnd after the last sample
+		time.AfterFunc(sessionEndGrace, func() {
+			if qs.finalize(key, q, now) {
+				log.Printf("sampling session of query %s did not end", key)
+				q.EndSampling()
+			}
+		})
+	}
+}
+
+// SessionEnd handles the end of the sampling session of a query, a finished
+// query is done then
+func (qs *QueryMsgProcessor) SessionEnd(key QueryKey) {
+	q, ok := qs.GetQuery(key)
+	if !ok {
+		return
+	}
+	q.endSession()
+	if q.status() == finish {
+		q.rwlock.RLock()
+		end := q.EndTime
+		q.rwlock.RUnlock()
+		qs.finalize(key, q, end)
+	}
+}
+
+// finalize saves and removes an ended query once, a parallel worker hands its
+// last counters to the leader instead. It reports whether this call did it.
+func (qs *QueryMsgProcessor) finalize(key QueryKey, q *QueryInfo, end time.Time) bool {
+	done := false
+	q.finalizeOnce.Do(func() {
+		done = true
+		if q.Leader() != nil {
+			// the leader keeps the last counters of its workers
+			q.mergeIntoLeader(true)
+		} else {
+			qs.SaveHistory(key, end)
+		}
+		qs.removeQuery(key, q)
+	})
+	return done
+}
+
+// SaveHistory persists the query before it is removed
+func (qs *QueryMsgProcessor) SaveHistory(key QueryKey, end time.Time) {
+	q, ok := qs.GetQuery(key)
+	if !ok || qs.history == nil {
+		return
+	}
+	q.rwlock.Lock()
+	q.EndTime = end
+	if q.planTree != nil {
+		if pending := q.planTree.Pending(); pending > 0 {
+			log.Printf("%d plan nodes of query %s never met their parent", pending, key)
+		}
+	}
+	q.rwlock.Unlock()
+	q.UpdateProgress(end)
+	qs.checkMisestimates(key, q, end)
+	rec, err := NewHistoryRecord(q)
+	if err == nil {
+		err = qs.history.Save(rec)
+	}
+	if err != nil {
+		log.Printf("Failed to save history of query %s: %s", key, err)
+	}
+}
+
+// isLocal reports whether the backend runs next to the database shield is connected to
+func (qs *QueryMsgProcessor) isLocal(host string) bool {
+	return qs.backendDB != nil && (host == "" || host == qs.localHost)
+}
+
+func (qs *QueryMsgProcessor) UpdateInstrument(key QueryKey, instru map[string]string) {
+	if qi, ok := qs.GetQuery(key); ok {
+		if err := qi.UpdateNode(instru); err != nil {
+			log.Printf("query %s: %s", key, err)
+		}
+		if qi.Leader() != nil {
+			qi.mergeIntoLeader(false)
+		}
+	}
+}
+
+// Export sends the plan of the query to the websocket clients, a parallel
+// worker sends the plan of its leader
+func (qs *QueryMsgProcessor) Export(key QueryKey) {
+	qi, ok := qs.GetQuery(key)
+	if !ok || qs.Queryhub == nil {
+		return
+	}
+	if leader := qi.Leader(); leader != nil {
+		qi = leader
+		key = QueryKey{leader.Host, leader.Pid}
+	}
+	now := time.Now()
+	qi.UpdateProgress(now)
+	qs.checkMisestimates(key, qi, now)
+	qi.rwlock.RLock()
+	result, err := json.Marshal(PlanMessage{"query", qi})
+	msg := &HubMessage{key, qi.Dbname, qi.Username, result}
+	qi.rwlock.RUnlock()
+	if err == nil {
+		qs.Queryhub.broadcast <- msg
+	}
+}
+
+// checkMisestimates flags the misestimated plan nodes of the query and sends
+// each new one to the websocket clients
+func (qs *QueryMsgProcessor) checkMisestimates(key QueryKey, qi *QueryInfo, now time.Time) {
+	if qs.conf == nil || qs.conf.MisestimateFactor == 0 {
+		return
+	}
+	for _, m := range qi.CheckMisestimates(qs.conf.MisestimateFactor, now) {
+		log.Printf("query %s: %s estimated %.0f rows, got %.0f", key, m.NodeType, m.EstimatedRows, m.ActualRows)
+		if qs.Queryhub == nil {
+			continue
+		}
+		qi.rwlock.RLock()
+		dbname, username := qi.Dbname, qi.Username
+		qi.rwlock.RUnlock()
+		result, err := json.Marshal(MisestimateMessage{"misestimate", key.Host, key.Pid, m})
 		if err == nil {
-			qs.Queryhub.broadcast <- result
+			qs.Queryhub.broadcast <- &HubMessage{key, dbname, username, result}
 		}
 	}
 }
-func (qs *QueryMsgProcessor) IsQueryExist(pid int) bool {
-	if _, ok := qs.Queries[pid]; ok {
-		return true
+
+func (qs *QueryMsgProcessor) IsQueryExist(key QueryKey) bool {
+	_, ok := qs.GetQuery(key)
+	return ok
+}
+
+// ResolveKey finds the query of a pid, the host may be omitted when the pid is unique
+func (qs *QueryMsgProcessor) ResolveKey(host string, pid int) (QueryKey, bool) {
+	if host != "" {
+		key := QueryKey{host, pid}
+		return key, qs.IsQueryExist(key)
+	}
+	qs.lock.RLock()
+	defer qs.lock.RUnlock()
+	found := []QueryKey{}
+	for key := range qs.Queries {
+		if key.Pid == pid {
+			found = append(found, key)
+		}
+	}
+	if len(found) != 1 {
+		return QueryKey{Pid: pid}, false
 	}
-	return false
+	return found[0], true
 }
-func (qs *QueryMsgProcessor) GetQueryDetails(pid int) error {
-	qs.backendDB.db.CleanTokens().Select("datname, usename, query, state").From("pg_stat_activity").Where(fmt.Sprintf("pid = %d", pid)).And("coalesce(datname, '') <> ''")
+
+func (qs *QueryMsgProcessor) GetQueryDetails(key QueryKey) error {
+	if qs.backendDB == nil || qs.backendDB.db == nil {
+		return fmt.Errorf("No database connection")
+	}
+	query, ok := qs.GetQuery(key)
+	if !ok {
+		return fmt.Errorf("Query not found")
+	}
+	// ActiveRecord keeps the statement in its tokens, only one caller at a time
+	qs.backendDB.lock.Lock()
+	qs.backendDB.db.CleanTokens().Select("datname, usename, query, state").From("pg_stat_activity").Where(fmt.Sprintf("pid = %d", key.Pid)).And("coalesce(datname, '') <> ''")
 	rows, err := qs.backendDB.db.GetRows()
-	query := qs.Queries[pid]
+	qs.backendDB.lock.Unlock()
 	if err != nil {
 		return err
 	}
 	if len(rows) > 0 {
-		query.Dbname = rows[0]["datname"].(string)
-		query.Username = rows[0]["usename"].(string)
-		query.QueryText = rows[0]["query"].(string)
-		query.Status = rows[0]["state"].(string)
-		qs.Queries[pid] = query
+		query.rwlock.Lock()
+		defer query.rwlock.Unlock()
+		query.Dbname, _ = rows[0]["datname"].(string)
+		query.Username, _ = rows[0]["usename"].(string)
+		query.QueryText, _ = rows[0]["query"].(string)
 	} else {
 		return fmt.Errorf("Query not found")
 	}
@@ -92,43 +384,101 @@ func (qs *QueryMsgProcessor) GetQueryDetails(pid int) error {
 
 // InitPlan with "Plan" Node msg
 // Every ExecInitPlan is a new plan node
-func (qs *QueryMsgProcessor) InitPlan(pid int, msg string) {
-	if qi, ok := qs.Queries[pid]; ok {
+func (qs *QueryMsgProcessor) InitPlan(key QueryKey, plan map[string]string) {
+	if qi, ok := qs.GetQuery(key); ok {
 		planstate := new(pg.PlanStateWrapper)
-		planstate.InitPlanStateWrapperFromExecInitPlan(msg)
+		if _, err := planstate.GeneratePlanState(plan); err != nil {
+			log.Printf("query %s: %s", key, err)
+		}
+		planstate.NodeTypeString = qi.profile.NodeTypeString(planstate.PlanNodeType)
 		qi.UpdatePlanStateTree(planstate)
+		if _, isWorker := plan["leader"]; isWorker && qi.Leader() == nil {
+			qs.attachWorker(key, qi, plan)
+		}
+		qs.startSampling(key, qi)
 	}
 
 }
 
-func (qs *QueryMsgProcessor) Process(msg []byte) error {
-	smsg := string(msg)
-	fields := strings.Split(smsg, "|")
-	if len(fields) < 2 {
-		return fmt.Errorf("Unspported msg type: %s", smsg)
+// PlanReady records how many nodes the plan of the query has, its sampling
+// session starts once all of them arrived
+func (qs *QueryMsgProcessor) PlanReady(key QueryKey, payload map[string]string) {
+	qi, ok := qs.GetQuery(key)
+	if !ok {
+		return
 	}
-	pid, err := strconv.Atoi(fields[0])
+	nodes, err := strconv.Atoi(payload["nodes"])
 	if err != nil {
-		return fmt.Errorf("Unspported msg type: %s", smsg)
+		log.Printf("query %s: invalid plan size %q", key, payload["nodes"])
+		return
+	}
+	qi.SetPlanSize(nodes)
+	qs.startSampling(key, qi)
+}
+
+func (qs *QueryMsgProcessor) startSampling(key QueryKey, qi *QueryInfo) {
+	if qs.comm == nil {
+		return
+	}
+	if err := qi.StartSampling(); err != nil && err != errPlanIncomplete && err != errSampling {
+		log.Printf("Failed to start sampling query %s: %s", key, err)
+	}
+}
+
+// attachWorker joins a parallel worker to the query of its leader backend,
+// workers of leaders not monitored stay queries of their own
+func (qs *QueryMsgProcessor) attachWorker(key QueryKey, qi *QueryInfo, plan map[string]string) {
+	leaderPid, err := strconv.Atoi(plan["leader"])
+	if err != nil {
+		return
+	}
+	number, err := strconv.Atoi(plan["worker"])
+	if err != nil {
+		return
+	}
+	leader, ok := qs.GetQuery(QueryKey{key.Host, leaderPid})
+	if !ok || leader == qi {
+		log.Printf("parallel worker %s: leader %d is not monitored", key, leaderPid)
+		return
+	}
+	qi.setLeader(leader, number)
+}
+
+func (qs *QueryMsgProcessor) Process(msg []byte) error {
+	probe, err := communicator.DecodeProbeMsg(msg)
+	if err != nil {
+		return err
+	}
+	key := QueryKey{probe.Host, probe.Pid}
+	if probe.Host != "" {
+		qs.touchAgent(probe.Host)
 	}
-	funcName := fields[1]
-	switch funcName {
+	switch probe.Event {
+	case "AgentRegister":
+		log.Printf("agent %s registered with profile %s", probe.Host, probe.Payload["profile"])
+		qs.registerAgent(probe.Host, probe.Payload["profile"], probe.Payload["profile_data"])
 	case "EndInstrument":
-		qs.Export(pid)
+		qs.Export(key)
 	case "GenerateNode":
-		qs.UpdateStatus(pid, start)
-		if len(fields) > 2 {
-			qs.InitPlan(pid, fields[2])
+		qs.UpdateStatus(key, start)
+		if len(probe.Payload) > 0 {
+			qs.InitPlan(key, probe.Payload)
 		}
+	case "PlanReady":
+		qs.PlanReady(key, probe.Payload)
+	case "SessionEnd":
+		qs.SessionEnd(key)
 	case "ExecutorFinish":
-		qs.UpdateStatus(pid, finish)
+		qs.UpdateStatus(key, finish)
 	case "CreateQueryDesc":
-		qs.UpdateStatus(pid, submit)
+		qs.UpdateStatus(key, submit)
 	case "StatementCancelHandler":
-		qs.UpdateStatus(pid, cancel)
+		qs.UpdateStatus(key, cancel)
+	case "StopAck":
+		log.Printf("agent stopped monitoring %s", key)
 	case "GetInstrument":
-		if len(fields) > 2 {
-			qs.UpdateInstrument(pid, fields[2])
+		if len(probe.Payload) > 0 {
+			qs.UpdateInstrument(key, probe.Payload)
 		}
 	}
 	return nil
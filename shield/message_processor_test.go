@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"postTap/communicator"
+	"postTap/config"
+	"postTap/probe"
+	"postTap/shield/pg"
+)
+
+// probeStream is the sequence of probes one backend sends for one query
+func probeStream(host string, pid int) [][]byte {
+	events := []struct {
+		event   string
+		payload map[string]string
+	}{
+		{"CreateQueryDesc", nil},
+		{"GenerateNode", map[string]string{"plantype": "140", "plan": "0x100", "leftplan": "0x200", "rightplan": "0x0", "plan_rows": "0x408f400000000000"}},
+		{"GenerateNode", map[string]string{"plantype": "128", "plan": "0x200", "leftplan": "0x0", "rightplan": "0x0", "plan_rows": "0x408f400000000000"}},
+		{"GetInstrument", map[string]string{"plannode": "0x200", "ntuples": "0x4059000000000000"}},
+		{"EndInstrument", nil},
+		{"ExecutorFinish", nil},
+	}
+	result := [][]byte{}
+	for _, e := range events {
+		msg, _ := communicator.NewProbeMsg(host, pid, e.event, e.payload).Encode()
+		result = append(result, msg)
+	}
+	return result
+}
+
+func TestConcurrentProbeStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posttap-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	comm, _ := communicator.NewCommunicator("inproc://test-concurrent")
+	defer comm.Close()
+	conf := config.Default()
+	processor := newQueryMsgProcessor(conf, comm)
+	processor.history, _ = NewHistoryStore(dir, 0, 0)
+	processor.Queryhub = newHub()
+	go processor.Queryhub.Run()
+	qs = processor
+
+	const hosts, pids = 4, 20
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+
+	// readers hit the registry the way http handlers do
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, qi := range processor.ListQueries() {
+					if _, err := qi.GetPlanJSON(); err != nil {
+						t.Error(err)
+					}
+					qi.Summary()
+				}
+				processor.ResolveKey("", 1)
+				serveQueries(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/queries", nil))
+				serveQuery(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/queries/1/plan?host=host0", nil))
+			}
+		}()
+	}
+
+	for h := 0; h < hosts; h++ {
+		for p := 1; p <= pids; p++ {
+			writers.Add(1)
+			go func(host string, pid int) {
+				defer writers.Done()
+				for _, msg := range probeStream(host, pid) {
+					if err := processor.Process(msg); err != nil {
+						t.Error(err)
+					}
+				}
+			}(fmt.Sprintf("host%d", h), p)
+		}
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	if left := processor.ListQueries(); len(left) != 0 {
+		t.Errorf("%d queries left after all streams finished", len(left))
+	}
+	if len(processor.Agents) != hosts {
+		t.Errorf("expected %d agents, got %d", hosts, len(processor.Agents))
+	}
+	records, _ := processor.history.Find(nil, 0)
+	if len(records) != hosts*pids {
+		t.Fatalf("expected %d history records, got %d", hosts*pids, len(records))
+	}
+	for _, rec := range records {
+		if rec.Plan == nil || len(rec.Plan.Childrens) != 1 || rec.Plan.Childrens[0].NTuples != 100 {
+			t.Errorf("incomplete plan for %s:%d", rec.Host, rec.Pid)
+			break
+		}
+	}
+}
+
+// the history record of a query is saved while late samples still update
+// its plan, run with -race
+func TestSaveHistoryWhileUpdating(t *testing.T) {
+	processor := newQueryMsgProcessor(config.Default(), nil)
+	var err error
+	if processor.history, err = NewHistoryStore(t.TempDir(), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	stream := probeStream("db1", 7)
+	for _, msg := range stream[:3] {
+		if err := processor.Process(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := QueryKey{"db1", 7}
+	done := make(chan struct{})
+	var updates sync.WaitGroup
+	var updated int64
+	updates.Add(1)
+	go func() {
+		defer updates.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			payload := map[string]string{"plannode": "0x200", "ntuples": fmt.Sprintf("0x%x", math.Float64bits(float64(i)))}
+			msg, _ := communicator.NewProbeMsg("db1", 7, "GetInstrument", payload).Encode()
+			processor.Process(msg)
+			atomic.AddInt64(&updated, 1)
+		}
+	}()
+	saves := 0
+	for ; saves < 20 || atomic.LoadInt64(&updated) < 100; saves++ {
+		processor.SaveHistory(key, time.Now())
+	}
+	close(done)
+	updates.Wait()
+	records, _ := processor.history.Find(nil, 0)
+	if len(records) != saves || records[0].Plan == nil || len(records[0].Plan.Childrens) != 1 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+func TestRegisterAgentProfileData(t *testing.T) {
+	qs := newQueryMsgProcessor(config.Default(), nil)
+	data := `{"name":"dwarf","planstate_instrument":40,"first_planstate_tag":7,"planstate_tags":["PlanState","ResultState"]}`
+	msg, _ := communicator.NewProbeMsg("db1", 0, "AgentRegister", map[string]string{"profile": "dwarf", "profile_data": data}).Encode()
+	if err := qs.Process(msg); err != nil {
+		t.Fatal(err)
+	}
+	profile := qs.profileFor("db1")
+	if profile.Name != "dwarf" || profile.PlanStateInstrument != 40 || profile.NodeTypeString(8) != "Result" {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	// without data the profile is looked up by name
+	msg, _ = communicator.NewProbeMsg("db2", 0, "AgentRegister", map[string]string{"profile": "pg13"}).Encode()
+	qs.Process(msg)
+	if profile := qs.profileFor("db2"); profile.Name != "pg13" {
+		t.Fatalf("unexpected profile %s", profile.Name)
+	}
+}
+
+func TestMisestimateEvent(t *testing.T) {
+	qs := newQueryMsgProcessor(config.Default(), nil)
+	qs.Queryhub = newHub()
+	go qs.Queryhub.Run()
+	client := newFakeClient(10)
+	sub := NewSubscription()
+	sub.All = true
+	qs.Queryhub.register <- &registration{client, sub}
+
+	key := QueryKey{"db1", 42}
+	qs.Queries[key] = &QueryInfo{Pid: 42, Host: "db1", statusCode: start, conf: qs.conf,
+		PlanStateRoot: &pg.PlanStateWrapper{NodeTypeString: "Seq Scan", Plan: &pg.NodeStore{Address: 0x100}, PlanRows: 10, Running: true, TupleCount: 500}}
+	qs.Export(key)
+	// a second sample does not report the node again
+	qs.Export(key)
+	qs.Queryhub.unregister <- client
+
+	events := 0
+	for _, msg := range client.received {
+		var event MisestimateMessage
+		if json.Unmarshal(msg, &event) == nil && event.MessageType == "misestimate" {
+			events++
+			if event.Pid != 42 || event.Host != "db1" || event.Misestimate.Factor != 50 {
+				t.Errorf("unexpected event %s", msg)
+			}
+		}
+	}
+	if events != 1 || len(client.received) != 3 {
+		t.Errorf("got %d misestimate events in %d messages", events, len(client.received))
+	}
+	qi, _ := qs.GetQuery(key)
+	if rec, err := NewHistoryRecord(qi); err != nil || len(rec.Misestimates) != 1 {
+		t.Error("misestimate not kept for history")
+	}
+}
+
+func TestParallelWorker(t *testing.T) {
+	comm, _ := communicator.NewCommunicator("inproc://test-parallel")
+	defer comm.Close()
+	conf := config.Default()
+	qs := newQueryMsgProcessor(conf, comm)
+	send := func(pid int, event string, payload map[string]string) {
+		msg, _ := communicator.NewProbeMsg("db1", pid, event, payload).Encode()
+		if err := qs.Process(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(10, "CreateQueryDesc", nil)
+	send(10, "GenerateNode", map[string]string{"plantype": "89", "plan": "0x100", "leftplan": "0x200", "rightplan": "0x0", "root": "0x100", "plan_node_id": "0"})
+	send(10, "GenerateNode", map[string]string{"plantype": "63", "plan": "0x200", "leftplan": "0x0", "rightplan": "0x0", "root": "0x100", "plan_node_id": "1"})
+	send(11, "CreateQueryDesc", nil)
+	send(11, "GenerateNode", map[string]string{"plantype": "63", "plan": "0x900", "leftplan": "0x0", "rightplan": "0x0", "root": "0x900", "plan_node_id": "1", "leader": "10", "worker": "0"})
+	send(11, "GetInstrument", map[string]string{"plannode": "0x900", "ntuples": "0x4059000000000000", "nloops": "0x3ff0000000000000"})
+
+	if queries := qs.ListQueries(); len(queries) != 1 || queries[0].Pid != 10 {
+		t.Fatalf("expected only the leader to be listed, got %d queries", len(queries))
+	}
+	leader, _ := qs.GetQuery(QueryKey{"db1", 10})
+	leader.rwlock.RLock()
+	gather := leader.PlanStateRoot
+	leader.rwlock.RUnlock()
+	if gather.WorkersLaunched != 1 || len(gather.Childrens) != 1 {
+		t.Fatalf("gather %+v", gather)
+	}
+	if workers := gather.Childrens[0].Workers; len(workers) != 1 || workers[0].NTuples != 100 || workers[0].Finished {
+		t.Errorf("workers %+v", workers)
+	}
+
+	send(11, "ExecutorFinish", nil)
+	if _, ok := qs.GetQuery(QueryKey{"db1", 11}); ok {
+		t.Error("finished worker still registered")
+	}
+	if workers := gather.Childrens[0].Workers; len(workers) != 1 || !workers[0].Finished {
+		t.Errorf("workers after finish %+v", workers)
+	}
+}
+
+// recordingComm keeps the commands shield sends to agents
+type recordingComm struct {
+	lock     sync.Mutex
+	commands []communicator.CommandMsg
+}
+
+func (c *recordingComm) Connect(uri string) error                              { return nil }
+func (c *recordingComm) Receive(queue string, p communicator.MessageProcessor) {}
+func (c *recordingComm) Close() error                                          { return nil }
+func (c *recordingComm) Send(queue string, msg []byte) error {
+	var command communicator.CommandMsg
+	if err := json.Unmarshal(msg, &command); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.commands = append(c.commands, command)
+	return nil
+}
+
+func (c *recordingComm) sent() []communicator.CommandMsg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]communicator.CommandMsg{}, c.commands...)
+}
+
+func TestSamplingSession(t *testing.T) {
+	comm := &recordingComm{}
+	conf := config.Default()
+	qs := newQueryMsgProcessor(conf, comm)
+	send := func(event string, payload map[string]string) {
+		msg, _ := communicator.NewProbeMsg("db1", 30, event, payload).Encode()
+		if err := qs.Process(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := QueryKey{"db1", 30}
+	send("CreateQueryDesc", nil)
+	send("GenerateNode", map[string]string{"plantype": "63", "plan": "0x100", "leftplan": "0x200", "rightplan": "0x0", "root": "0x100", "instrument": "0x1000"})
+	// the plan size may arrive before the last node
+	send("PlanReady", map[string]string{"nodes": "2"})
+	if len(comm.sent()) != 0 {
+		t.Fatal("sampling started before the plan is complete")
+	}
+	send("GenerateNode", map[string]string{"plantype": "63", "plan": "0x200", "leftplan": "0x0", "rightplan": "0x0", "root": "0x100", "instrument": "0x2000"})
+	commands := comm.sent()
+	if len(commands) != 1 || commands[0].CommandName != "START" || commands[0].Pid != 30 {
+		t.Fatalf("expected one START command, got %+v", commands)
+	}
+	sampler := commands[0].Sampler
+	if sampler == nil || sampler.Root != 256 || len(sampler.Nodes) != 2 || sampler.Nodes[1] != 512 || sampler.Interval != time.Second || sampler.RootOffset != 88 {
+		t.Fatalf("wrong sampler %+v", sampler)
+	}
+	// later nodes do not start a second session
+	send("GenerateNode", map[string]string{"plantype": "63", "plan": "0x200", "leftplan": "0x0", "rightplan": "0x0", "root": "0x100"})
+	if len(comm.sent()) != 1 {
+		t.Error("sampling started twice")
+	}
+
+	// a finished query waits for the last sample of its session
+	send("ExecutorFinish", nil)
+	if !qs.IsQueryExist(key) {
+		t.Fatal("query removed before the session ended")
+	}
+	send("GetInstrument", map[string]string{"plannode": "0x200", "ntuples": "0x4059000000000000"})
+	send("EndInstrument", nil)
+	send("SessionEnd", nil)
+	if qs.IsQueryExist(key) {
+		t.Error("query kept after the session ended")
+	}
+	if len(comm.sent()) != 1 {
+		t.Errorf("finished session was stopped: %+v", comm.sent())
+	}
+
+	// the next query of the backend does not wait for a lost SessionEnd
+	send("CreateQueryDesc", nil)
+	send("GenerateNode", map[string]string{"plantype": "63", "plan": "0x100", "leftplan": "0x0", "rightplan": "0x0", "root": "0x100"})
+	send("PlanReady", map[string]string{"nodes": "1"})
+	// the stap rendering is the same for every plan so the agent reuses its module
+	if commands = comm.sent(); len(commands) != 2 || probe.Stap(&probe.Script{Sampler: commands[1].Sampler}) != probe.Stap(&probe.Script{Sampler: sampler}) {
+		t.Errorf("second query sampled with %+v", commands)
+	}
+	send("ExecutorFinish", nil)
+	send("CreateQueryDesc", nil)
+	if qi, ok := qs.GetQuery(key); !ok || qi.status() != submit {
+		t.Error("new query of the backend not registered")
+	}
+}
@@ -2,8 +2,9 @@ package pg
 
 import (
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // NodeStore: node address information
@@ -11,6 +12,27 @@ type NodeStore struct {
 	Address   uint64
 	leftAddr  uint64
 	rightAddr uint64
+	// parentAddr and relationship are set for children beyond lefttree and
+	// righttree, like Append members, init plans and sub plans
+	parentAddr   uint64
+	relationship string
+	// rootAddr is desc->planstate of the query the node belongs to, seq the
+	// position of the node in the depth first walk of the probe
+	rootAddr uint64
+	seq      int
+	// planNodeID is plan_node_id of the Plan, it matches the nodes of
+	// parallel workers with the leader, -1 when the agent did not send it
+	planNodeID int
+}
+
+// relationshipOrder sorts the children of a node the way EXPLAIN lists them
+var relationshipOrder = map[string]int{
+	"InitPlan": 0,
+	"Outer":    1,
+	"Inner":    2,
+	"Member":   3,
+	"Subquery": 3,
+	"SubPlan":  4,
 }
 
 // typedef struct BufferUsage
@@ -42,11 +64,18 @@ type PlanStateWrapper struct {
 	Running            bool                `json:"Running"`
 	StartupCost        float64             `json:"StartupCost"`
 	TotalCost          float64             `json:"TotalCost"`
+	ParallelAware      bool                `json:"Parallel Aware"`
+	// AsyncCapable is nil before PG14
+	AsyncCapable *bool `json:"Async Capable,omitempty"`
+	// SetParams are the ids of the params an init plan returns
+	SetParams []int `json:"Set Params,omitempty"`
 	// Accumulated
 	Startup   float64 `json:"Startup Time,omitempty"`
 	TotalTime float64 `json:"Total Time,omitempty"`
 	NTuples   float64 `json:"Actual Rows,omitempty"`
 	NLoops    float64 `json:"Actual Loops,omitempty"`
+	// Progress is the estimated completion of the node from 0 to 1
+	Progress float64 `json:"Progress"`
 	// Buffer
 	SharedHitBlocks     uint64 `json:"Shared Hit Blocks,omitempty"`
 	SharedReadBlocks    uint64 `json:"Shared Read Blocks,omitempty"`
@@ -58,24 +87,40 @@ type PlanStateWrapper struct {
 	LocalWrittenBlocks  uint64 `json:"Local Written Blocks,omitempty"`
 	TempReadBlocks      uint64 `json:"Temp Read Blocks,omitempty"`
 	TempWrittenBlocks   uint64 `json:"Temp Written Blocks,omitempty"`
+	// Workers holds the counters of the parallel workers running the node,
+	// WorkersPlanned and WorkersLaunched are set on Gather and Gather Merge
+	Workers         []*WorkerInstrumentation `json:"Workers,omitempty"`
+	WorkersPlanned  int                      `json:"Workers Planned,omitempty"`
+	WorkersLaunched int                      `json:"Workers Launched,omitempty"`
 	//	IOReadTime          uint64              `json:"I/O Read Time,omitempty"`
 }
 
-type PlanFunction func(*PlanStateWrapper) interface{}
+// fieldErrors collects the fields of a probe message that could not be
+// parsed, the message comes from the network and the other fields are kept
+type fieldErrors []string
+
+func (e *fieldErrors) add(key string, val string, err error) {
+	if err != nil {
+		*e = append(*e, fmt.Sprintf("%s:%q", key, val))
+	}
+}
 
-func PrintInstrument(ps *PlanStateWrapper) interface{} {
-	if ps.Plan.Address == 0 || ps.Instrument == 0 {
-		return []byte{}
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
 	}
-	codeline := []byte(fmt.Sprintf("\tprintdln(\"|\", pid(), \"GetInstrument\", parse_instrument(%d, %d))\n", ps.Plan.Address, ps.Instrument))
-	return codeline
+	sort.Strings(e)
+	return fmt.Errorf("Invalid fields %s", strings.Join(e, ","))
 }
 
-// GeneratePlanState Initilize the planstate and some info we can get during plan
-func (ps *PlanStateWrapper) GeneratePlanState(plan map[string]string) uint64 {
-	pnodeStore := new(NodeStore)
-	var err error
+// GeneratePlanState Initilize the planstate and some info we can get during
+// plan, fields that do not parse are skipped and returned in the error
+func (ps *PlanStateWrapper) GeneratePlanState(plan map[string]string) (uint64, error) {
+	pnodeStore := &NodeStore{planNodeID: -1}
+	invalid := fieldErrors{}
+	setParam, setParams := 0, 0
 	for key, val := range plan {
+		var err error
 		switch key {
 		case "plantype":
 			ps.PlanNodeType, err = strconv.Atoi(val)
@@ -86,119 +131,143 @@ func (ps *PlanStateWrapper) GeneratePlanState(plan map[string]string) uint64 {
 		case "rightplan":
 			pnodeStore.rightAddr, err = strconv.ParseUint(val, 0, 64)
 		case "plan_rows":
-			ps.PlanRows, err = ConvertHexToFloat64(val[2:])
+			ps.PlanRows, err = parseHexFloat64(val)
 		case "startup_cost":
-			ps.StartupCost, err = ConvertHexToFloat64(val[2:])
+			ps.StartupCost, err = parseHexFloat64(val)
 		case "total_cost":
-			ps.TotalCost, err = ConvertHexToFloat64(val[2:])
+			ps.TotalCost, err = parseHexFloat64(val)
 		case "plan_width":
 			ps.PlanWidth, err = strconv.Atoi(val)
+		case "parallel_aware":
+			ps.ParallelAware, err = parseFlag(val)
+		case "async_capable":
+			var async bool
+			if async, err = parseFlag(val); err == nil {
+				ps.AsyncCapable = &async
+			}
+		case "num_workers":
+			ps.WorkersPlanned, err = strconv.Atoi(val)
+		case "setparam":
+			setParam, err = strconv.Atoi(val)
+		case "setparams":
+			setParams, err = strconv.Atoi(val)
 		case "instrument":
 			ps.Instrument, err = strconv.ParseUint(val, 0, 64)
+		case "parent":
+			pnodeStore.parentAddr, err = strconv.ParseUint(val, 0, 64)
+		case "relationship":
+			pnodeStore.relationship = val
+		case "root":
+			pnodeStore.rootAddr, err = strconv.ParseUint(val, 0, 64)
+		case "seq":
+			pnodeStore.seq, err = strconv.Atoi(val)
+		case "plan_node_id":
+			// -1 stays for a node without an id
+			var id int
+			if id, err = strconv.Atoi(val); err == nil {
+				pnodeStore.planNodeID = id
+			}
 		}
-		if err != nil {
-			log.Fatal(err)
-		}
+		invalid.add(key, val, err)
 	}
 	if ps.PlanNodeType != 0 {
 		ps.NodeTypeString = GetNodeTypeString(ps.PlanNodeType)
 	}
+	// the planner numbers the params of an init plan one after the other,
+	// the count read from the server is bounded
+	for i := 0; i < setParams && i < 100; i++ {
+		ps.SetParams = append(ps.SetParams, setParam+i)
+	}
 
 	ps.Plan = pnodeStore
-	return ps.Plan.Address
+	return ps.Plan.Address, invalid.err()
 }
 
-func (ps *PlanStateWrapper) IsLeftChild(child *PlanStateWrapper) bool {
-	if ps.Plan != nil && ps.Plan.leftAddr != 0 &&
-		ps.Plan.leftAddr == child.Plan.Address {
-		return true
+// addChild inserts the child after the children that come before it in
+// EXPLAIN, siblings of one relationship keep the order the probe walked them
+func (ps *PlanStateWrapper) addChild(child *PlanStateWrapper, relationship string) {
+	child.ParentRelationship = relationship
+	i := len(ps.Childrens)
+	for i > 0 && ps.Childrens[i-1].after(child) {
+		i--
 	}
-
-	return false
+	ps.Childrens = append(ps.Childrens, nil)
+	copy(ps.Childrens[i+1:], ps.Childrens[i:])
+	ps.Childrens[i] = child
 }
 
-func (ps *PlanStateWrapper) IsRightChild(child *PlanStateWrapper) bool {
-	if ps.Plan != nil && ps.Plan.rightAddr != 0 &&
-		ps.Plan.rightAddr == child.Plan.Address {
-		return true
+func (ps *PlanStateWrapper) after(other *PlanStateWrapper) bool {
+	order, otherOrder := relationshipOrder[ps.ParentRelationship], relationshipOrder[other.ParentRelationship]
+	if order != otherOrder || ps.Plan == nil || other.Plan == nil {
+		return order > otherOrder
 	}
-
-	return false
+	return ps.Plan.seq > other.Plan.seq
 }
 
-func (ps *PlanStateWrapper) InsertNewNode(node *PlanStateWrapper) bool {
-	if ps == nil {
-		return false
-	}
-	if len(ps.Childrens) == 0 && ps.IsLeftChild(node) {
-		node.ParentRelationship = "Outer"
-		ps.Childrens = append(ps.Childrens, node)
-		return true
-	}
-	if len(ps.Childrens) == 1 && ps.IsRightChild(node) {
-		node.ParentRelationship = "Inner"
-		ps.Childrens = append(ps.Childrens, node)
-		return true
-	}
-	if len(ps.Childrens) == 1 && ps.Childrens[0].InsertNewNode(node) {
-		return true
-	}
-	if len(ps.Childrens) == 2 && ps.Childrens[1].InsertNewNode(node) {
-		return true
-	}
-	return false
+func (ps *PlanStateWrapper) InitPlanStateWrapperFromExecInitPlan(msg string) error {
+	_, err := ps.GeneratePlanState(ParsePlanString(msg))
+	return err
 }
 
-func (ps *PlanStateWrapper) FindNodeByAddr(addr uint64) *PlanStateWrapper {
-	if ps == nil || addr == 0 {
+// Addresses returns the addresses of the nodes in plan order
+func (ps *PlanStateWrapper) Addresses() []uint64 {
+	if ps == nil {
 		return nil
 	}
-	if ps.Plan.Address == addr {
-		return ps
-	}
-	if len(ps.Childrens) > 0 {
-		if leftRes := ps.Childrens[0].FindNodeByAddr(addr); leftRes != nil {
-			return leftRes
-		} else if len(ps.Childrens) == 2 {
-			return ps.Childrens[1].FindNodeByAddr(addr)
-		}
-	}
-	return nil
-}
-
-func (ps *PlanStateWrapper) InitPlanStateWrapperFromExecInitPlan(msg string) {
-	ps.GeneratePlanState(ParsePlanString(msg))
-}
-
-func (ps *PlanStateWrapper) TranverseGenSTAP(fn PlanFunction) []byte {
-	if ps == nil {
-		return []byte{}
+	result := []uint64{}
+	if ps.Plan != nil && ps.Plan.Address != 0 {
+		result = append(result, ps.Plan.Address)
 	}
-	result := fn(ps).([]byte)
 	for _, child := range ps.Childrens {
-		result = append(result, child.TranverseGenSTAP(fn)...)
+		result = append(result, child.Addresses()...)
 	}
 	return result
 }
 
-// UpdateInfo update Plannode info according a string map
-func (ps *PlanStateWrapper) UpdateInfo(info map[string]string) {
+// UpdateInfo update Plannode info according a string map, fields that do
+// not parse keep their last value and are returned in the error
+func (ps *PlanStateWrapper) UpdateInfo(info map[string]string) error {
+	invalid := fieldErrors{}
+	counters := map[string]*uint64{
+		"instrument":          &ps.Instrument,
+		"shared_blks_hit":     &ps.SharedHitBlocks,
+		"shared_blks_read":    &ps.SharedReadBlocks,
+		"shared_blks_dirtied": &ps.SharedDirtiedBlocks,
+		"shared_blks_written": &ps.SharedWrittenBlocks,
+		"local_blks_hit":      &ps.LocalHitBlocks,
+		"local_blks_read":     &ps.LocalReadBlocks,
+		"local_blks_dirtied":  &ps.LocalDirtiedBlocks,
+		"local_blks_written":  &ps.LocalWrittenBlocks,
+		"temp_blks_read":      &ps.TempReadBlocks,
+		"temp_blks_written":   &ps.TempWrittenBlocks,
+	}
+	doubles := map[string]*float64{
+		"tuplecount": &ps.TupleCount,
+		"startup":    &ps.Startup,
+		"total":      &ps.TotalTime,
+		"ntuples":    &ps.NTuples,
+		"nloops":     &ps.NLoops,
+	}
 	for key, val := range info {
-		switch key {
-		case "tuplecount":
-			ps.TupleCount, _ = ConvertHexToFloat64(val[2:])
-		case "running":
-			ps.Running, _ = strconv.ParseBool(val[2:])
-		case "startup":
-			ps.Startup, _ = ConvertHexToFloat64(val[2:])
-		case "total":
-			ps.TotalTime, _ = ConvertHexToFloat64(val[2:])
-		case "ntuples":
-			ps.NTuples, _ = ConvertHexToFloat64(val[2:])
-		case "nloops":
-			ps.NLoops, _ = ConvertHexToFloat64(val[2:])
-		case "instrument":
-			ps.Instrument, _ = strconv.ParseUint(val, 0, 64)
+		if counter, ok := counters[key]; ok {
+			n, err := strconv.ParseUint(val, 0, 64)
+			if err == nil {
+				*counter = n
+			}
+			invalid.add(key, val, err)
+		} else if double, ok := doubles[key]; ok {
+			f, err := parseHexFloat64(val)
+			if err == nil {
+				*double = f
+			}
+			invalid.add(key, val, err)
+		} else if key == "running" {
+			running, err := parseFlag(val)
+			if err == nil {
+				ps.Running = running
+			}
+			invalid.add(key, val, err)
 		}
 	}
+	return invalid.err()
 }
@@ -38,3 +38,61 @@ func TestConvertHexToFloat64(t *testing.T) {
 		t.Errorf("fail convert hex to float64 %f", res)
 	}
 }
+func TestParsePlanStringWithoutColon(t *testing.T) {
+	res := ParsePlanString("plantype:117,broken, plan_rows:0x0")
+	if _, ok := res["broken"]; ok {
+		t.Error("field without colon should be skipped")
+	}
+	if res["plan_rows"] != "0x0" {
+		t.Errorf("plan rows parse error %s", res["plan_rows"])
+	}
+}
+func TestUpdateBufferUsage(t *testing.T) {
+	ps := new(PlanStateWrapper)
+	ps.UpdateInfo(ParsePlanString("plannode:0x1234,shared_blks_hit:0x2a,shared_blks_read:0x7,temp_blks_written:0x0"))
+	if ps.SharedHitBlocks != 42 || ps.SharedReadBlocks != 7 || ps.TempWrittenBlocks != 0 {
+		t.Errorf("buffer usage parse error %+v", ps)
+	}
+}
+func TestGeneratePlanStateMalformed(t *testing.T) {
+	ps := new(PlanStateWrapper)
+	err := ps.InitPlanStateWrapperFromExecInitPlan("plantype:117,plan:0x1ae4630,plan_rows:0x,total_cost:,startup_cost:0xzz,plan_width:w,plan_node_id:x")
+	if err == nil || err.Error() != `Invalid fields plan_node_id:"x",plan_rows:"0x",plan_width:"w",startup_cost:"0xzz",total_cost:""` {
+		t.Errorf("unexpected error %v", err)
+	}
+	if ps.PlanNodeType != 117 || ps.Plan.Address != 28198448 || ps.Plan.planNodeID != -1 {
+		t.Errorf("valid fields lost %+v %+v", ps, ps.Plan)
+	}
+}
+func TestUpdateInfoMalformed(t *testing.T) {
+	ps := &PlanStateWrapper{NTuples: 3, Running: true, SharedHitBlocks: 5}
+	// values shorter than the 0x prefix
+	err := ps.UpdateInfo(ParsePlanString("plannode:0x1234,ntuples:x,running:,shared_blks_hit:zz,nloops:0x3ff0000000000000,total:0"))
+	if err == nil || err.Error() != `Invalid fields ntuples:"x",running:"",shared_blks_hit:"zz"` {
+		t.Errorf("unexpected error %v", err)
+	}
+	if ps.NTuples != 3 || !ps.Running || ps.SharedHitBlocks != 5 || ps.NLoops != 1 {
+		t.Errorf("malformed fields overwrote the node %+v", ps)
+	}
+	if err := ps.UpdateInfo(ParsePlanString("running:0x0")); err != nil || ps.Running {
+		t.Errorf("running parse error %v", err)
+	}
+}
+func TestGeneratePlanStateParams(t *testing.T) {
+	ps := new(PlanStateWrapper)
+	if err := ps.InitPlanStateWrapperFromExecInitPlan("plantype:117,plan:0x10,parallel_aware:0x1,setparam:3,setparams:2"); err != nil {
+		t.Fatal(err)
+	}
+	if !ps.ParallelAware || ps.AsyncCapable != nil || len(ps.SetParams) != 2 || ps.SetParams[0] != 3 || ps.SetParams[1] != 4 {
+		t.Errorf("unexpected node %+v", ps)
+	}
+	ps = new(PlanStateWrapper)
+	ps.InitPlanStateWrapperFromExecInitPlan("plantype:117,plan:0x10,parallel_aware:0x0,async_capable:0x1,setparam:0,setparams:0")
+	if ps.ParallelAware || ps.AsyncCapable == nil || !*ps.AsyncCapable || ps.SetParams != nil {
+		t.Errorf("unexpected node %+v", ps)
+	}
+	ps = new(PlanStateWrapper)
+	if err := ps.InitPlanStateWrapperFromExecInitPlan("plantype:117,plan:0x10,num_workers:4"); err != nil || ps.WorkersPlanned != 4 {
+		t.Errorf("workers planned %d, %v", ps.WorkersPlanned, err)
+	}
+}
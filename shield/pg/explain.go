@@ -0,0 +1,246 @@
+package pg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExplainOptions selects what an EXPLAIN export contains
+type ExplainOptions struct {
+	// Buffers adds the buffer usage like EXPLAIN (ANALYZE, BUFFERS)
+	Buffers bool
+	// ExecutionTime is printed when it is not zero, it is only known once
+	// the query finished
+	ExecutionTime time.Duration
+}
+
+// fixed is a float printed with a fixed number of decimals like EXPLAIN does
+type fixed struct {
+	val      float64
+	decimals int
+}
+
+func (f fixed) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(f.val, 'f', f.decimals, 64)), nil
+}
+
+func (f fixed) String() string {
+	return strconv.FormatFloat(f.val, 'f', f.decimals, 64)
+}
+
+// explainNode mirrors the keys of EXPLAIN (ANALYZE, FORMAT JSON) in their order
+type explainNode struct {
+	NodeType            string          `json:"Node Type"`
+	ParentRelationship  string          `json:"Parent Relationship,omitempty"`
+	SubplanName         string          `json:"Subplan Name,omitempty"`
+	ParallelAware       bool            `json:"Parallel Aware"`
+	AsyncCapable        *bool           `json:"Async Capable,omitempty"`
+	StartupCost         fixed           `json:"Startup Cost"`
+	TotalCost           fixed           `json:"Total Cost"`
+	PlanRows            fixed           `json:"Plan Rows"`
+	PlanWidth           int             `json:"Plan Width"`
+	ActualStartupTime   fixed           `json:"Actual Startup Time"`
+	ActualTotalTime     fixed           `json:"Actual Total Time"`
+	ActualRows          fixed           `json:"Actual Rows"`
+	ActualLoops         fixed           `json:"Actual Loops"`
+	WorkersPlanned      *int            `json:"Workers Planned,omitempty"`
+	WorkersLaunched     *int            `json:"Workers Launched,omitempty"`
+	SharedHitBlocks     *uint64         `json:"Shared Hit Blocks,omitempty"`
+	SharedReadBlocks    *uint64         `json:"Shared Read Blocks,omitempty"`
+	SharedDirtiedBlocks *uint64         `json:"Shared Dirtied Blocks,omitempty"`
+	SharedWrittenBlocks *uint64         `json:"Shared Written Blocks,omitempty"`
+	LocalHitBlocks      *uint64         `json:"Local Hit Blocks,omitempty"`
+	LocalReadBlocks     *uint64         `json:"Local Read Blocks,omitempty"`
+	LocalDirtiedBlocks  *uint64         `json:"Local Dirtied Blocks,omitempty"`
+	LocalWrittenBlocks  *uint64         `json:"Local Written Blocks,omitempty"`
+	TempReadBlocks      *uint64         `json:"Temp Read Blocks,omitempty"`
+	TempWrittenBlocks   *uint64         `json:"Temp Written Blocks,omitempty"`
+	Workers             []explainWorker `json:"Workers,omitempty"`
+	Plans               []*explainNode  `json:"Plans,omitempty"`
+}
+
+type explainWorker struct {
+	WorkerNumber      int   `json:"Worker Number"`
+	ActualStartupTime fixed `json:"Actual Startup Time"`
+	ActualTotalTime   fixed `json:"Actual Total Time"`
+	ActualRows        fixed `json:"Actual Rows"`
+	ActualLoops       fixed `json:"Actual Loops"`
+}
+
+type explainResult struct {
+	Plan          *explainNode `json:"Plan"`
+	Triggers      []string     `json:"Triggers"`
+	ExecutionTime *fixed       `json:"Execution Time,omitempty"`
+}
+
+// actuals returns the per loop averages EXPLAIN ANALYZE prints. A live
+// snapshot also counts the loop the node is running.
+func (ps *PlanStateWrapper) actuals() (startup float64, total float64, rows float64, loops float64) {
+	startup, total, rows, loops = ps.totals()
+	if loops <= 0 {
+		return 0, 0, 0, 0
+	}
+	return 1000 * startup / loops, 1000 * total / loops, rows / loops, loops
+}
+
+// subplanName numbers init plans and sub plans in plan order like EXPLAIN,
+// init plans name the params they return
+func (ps *PlanStateWrapper) subplanName(subplans *int) string {
+	if ps.ParentRelationship != "InitPlan" && ps.ParentRelationship != "SubPlan" {
+		return ""
+	}
+	*subplans++
+	name := fmt.Sprintf("%s %d", ps.ParentRelationship, *subplans)
+	if ps.ParentRelationship == "InitPlan" && len(ps.SetParams) > 0 {
+		params := []string{}
+		for _, id := range ps.SetParams {
+			params = append(params, fmt.Sprintf("$%d", id))
+		}
+		name += " (returns " + strings.Join(params, ",") + ")"
+	}
+	return name
+}
+
+// nodeName prefixes the node type like the TEXT format of EXPLAIN does
+func (ps *PlanStateWrapper) nodeName() string {
+	name := ps.NodeTypeString
+	if ps.AsyncCapable != nil && *ps.AsyncCapable {
+		name = "Async " + name
+	}
+	if ps.ParallelAware {
+		name = "Parallel " + name
+	}
+	return name
+}
+
+func (ps *PlanStateWrapper) explainNode(opts ExplainOptions, subplans *int) *explainNode {
+	startup, total, rows, loops := ps.actuals()
+	node := &explainNode{
+		NodeType:           ps.NodeTypeString,
+		ParentRelationship: ps.ParentRelationship,
+		SubplanName:        ps.subplanName(subplans),
+		ParallelAware:      ps.ParallelAware,
+		AsyncCapable:       ps.AsyncCapable,
+		StartupCost:        fixed{ps.StartupCost, 2},
+		TotalCost:          fixed{ps.TotalCost, 2},
+		PlanRows:           fixed{ps.PlanRows, 0},
+		PlanWidth:          ps.PlanWidth,
+		ActualStartupTime:  fixed{startup, 3},
+		ActualTotalTime:    fixed{total, 3},
+		ActualRows:         fixed{rows, 0},
+		ActualLoops:        fixed{loops, 0},
+	}
+	if opts.Buffers {
+		b := *ps
+		node.SharedHitBlocks, node.SharedReadBlocks = &b.SharedHitBlocks, &b.SharedReadBlocks
+		node.SharedDirtiedBlocks, node.SharedWrittenBlocks = &b.SharedDirtiedBlocks, &b.SharedWrittenBlocks
+		node.LocalHitBlocks, node.LocalReadBlocks = &b.LocalHitBlocks, &b.LocalReadBlocks
+		node.LocalDirtiedBlocks, node.LocalWrittenBlocks = &b.LocalDirtiedBlocks, &b.LocalWrittenBlocks
+		node.TempReadBlocks, node.TempWrittenBlocks = &b.TempReadBlocks, &b.TempWrittenBlocks
+	}
+	if ps.isGather() {
+		planned, launched := ps.WorkersPlanned, ps.WorkersLaunched
+		node.WorkersPlanned, node.WorkersLaunched = &planned, &launched
+	}
+	for _, w := range ps.Workers {
+		startup, total, rows, loops := w.actuals()
+		node.Workers = append(node.Workers, explainWorker{w.WorkerNumber, fixed{startup, 3}, fixed{total, 3}, fixed{rows, 0}, fixed{loops, 0}})
+	}
+	for _, child := range ps.Childrens {
+		node.Plans = append(node.Plans, child.explainNode(opts, subplans))
+	}
+	return node
+}
+
+// ExplainJSON renders the plan tree like EXPLAIN (ANALYZE, FORMAT JSON)
+func ExplainJSON(root *PlanStateWrapper, opts ExplainOptions) ([]byte, error) {
+	if root == nil {
+		return nil, fmt.Errorf("No plan")
+	}
+	subplans := 0
+	result := explainResult{Plan: root.explainNode(opts, &subplans), Triggers: []string{}}
+	if opts.ExecutionTime > 0 {
+		result.ExecutionTime = &fixed{float64(opts.ExecutionTime) / float64(time.Millisecond), 3}
+	}
+	return json.MarshalIndent([]explainResult{result}, "", "  ")
+}
+
+// ExplainText renders the plan tree like the TEXT format of EXPLAIN ANALYZE
+func ExplainText(root *PlanStateWrapper, opts ExplainOptions) string {
+	buf := new(bytes.Buffer)
+	subplans := 0
+	root.explainText(buf, 0, opts, &subplans)
+	if opts.ExecutionTime > 0 {
+		fmt.Fprintf(buf, "Execution Time: %.3f ms\n", float64(opts.ExecutionTime)/float64(time.Millisecond))
+	}
+	return buf.String()
+}
+
+// explainText follows the indentation of ExplainNode in explain.c, indent
+// counts steps of two spaces
+func (ps *PlanStateWrapper) explainText(buf *bytes.Buffer, indent int, opts ExplainOptions, subplans *int) {
+	if ps == nil {
+		return
+	}
+	if name := ps.subplanName(subplans); name != "" {
+		buf.WriteString(strings.Repeat("  ", indent) + name + "\n")
+		indent++
+	}
+	if indent > 0 {
+		buf.WriteString(strings.Repeat("  ", indent) + "->  ")
+		indent += 2
+	}
+	fmt.Fprintf(buf, "%s  (cost=%.2f..%.2f rows=%.0f width=%d)", ps.nodeName(), ps.StartupCost, ps.TotalCost, ps.PlanRows, ps.PlanWidth)
+	if startup, total, rows, loops := ps.actuals(); loops > 0 {
+		fmt.Fprintf(buf, " (actual time=%.3f..%.3f rows=%.0f loops=%.0f)\n", startup, total, rows, loops)
+	} else {
+		buf.WriteString(" (never executed)\n")
+	}
+	indent++
+	if ps.isGather() {
+		fmt.Fprintf(buf, "%sWorkers Planned: %d\n", strings.Repeat("  ", indent), ps.WorkersPlanned)
+		fmt.Fprintf(buf, "%sWorkers Launched: %d\n", strings.Repeat("  ", indent), ps.WorkersLaunched)
+	}
+	if opts.Buffers {
+		if line := ps.bufferText(); line != "" {
+			fmt.Fprintf(buf, "%sBuffers: %s\n", strings.Repeat("  ", indent), line)
+		}
+	}
+	for _, w := range ps.Workers {
+		if startup, total, rows, loops := w.actuals(); loops > 0 {
+			fmt.Fprintf(buf, "%sWorker %d:  actual time=%.3f..%.3f rows=%.0f loops=%.0f\n", strings.Repeat("  ", indent), w.WorkerNumber, startup, total, rows, loops)
+		}
+	}
+	for _, child := range ps.Childrens {
+		child.explainText(buf, indent, opts, subplans)
+	}
+}
+
+// bufferText is the Buffers line of the node, empty when nothing was counted
+func (ps *PlanStateWrapper) bufferText() string {
+	groups := []string{}
+	for _, group := range []struct {
+		name   string
+		labels []string
+		counts []uint64
+	}{
+		{"shared", []string{"hit", "read", "dirtied", "written"}, []uint64{ps.SharedHitBlocks, ps.SharedReadBlocks, ps.SharedDirtiedBlocks, ps.SharedWrittenBlocks}},
+		{"local", []string{"hit", "read", "dirtied", "written"}, []uint64{ps.LocalHitBlocks, ps.LocalReadBlocks, ps.LocalDirtiedBlocks, ps.LocalWrittenBlocks}},
+		{"temp", []string{"read", "written"}, []uint64{ps.TempReadBlocks, ps.TempWrittenBlocks}},
+	} {
+		parts := []string{}
+		for i, count := range group.counts {
+			if count > 0 {
+				parts = append(parts, fmt.Sprintf("%s=%d", group.labels[i], count))
+			}
+		}
+		if len(parts) > 0 {
+			groups = append(groups, group.name+" "+strings.Join(parts, " "))
+		}
+	}
+	return strings.Join(groups, ", ")
+}
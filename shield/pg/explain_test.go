@@ -0,0 +1,139 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// explainTree is a hash join over two scans like
+// SELECT * FROM t1 JOIN t2 USING (id)
+func explainTree() *PlanStateWrapper {
+	inner := &PlanStateWrapper{NodeTypeString: "Seq Scan", StartupCost: 0, TotalCost: 1.09, PlanRows: 9, PlanWidth: 4,
+		Startup: 0.000004, TotalTime: 0.000006, NTuples: 9, NLoops: 1, SharedHitBlocks: 1}
+	hash := &PlanStateWrapper{NodeTypeString: "Hash", ParentRelationship: "Inner", StartupCost: 1.09, TotalCost: 1.09, PlanRows: 9, PlanWidth: 4,
+		Startup: 0.000012, TotalTime: 0.000012, NTuples: 9, NLoops: 1, Childrens: []*PlanStateWrapper{inner}}
+	inner.ParentRelationship = "Outer"
+	outer := &PlanStateWrapper{NodeTypeString: "Seq Scan", ParentRelationship: "Outer", StartupCost: 0, TotalCost: 1.09, PlanRows: 9, PlanWidth: 4,
+		Running: true, TupleCount: 4}
+	return &PlanStateWrapper{NodeTypeString: "Hash Join", StartupCost: 1.20, TotalCost: 2.34, PlanRows: 9, PlanWidth: 8,
+		Startup: 0.00003, TotalTime: 0.000036, NTuples: 9, NLoops: 1, SharedHitBlocks: 2, TempReadBlocks: 3,
+		Childrens: []*PlanStateWrapper{outer, hash}}
+}
+
+func TestExplainText(t *testing.T) {
+	text := ExplainText(explainTree(), ExplainOptions{Buffers: true, ExecutionTime: 52 * time.Microsecond})
+	expected := strings.Join([]string{
+		"Hash Join  (cost=1.20..2.34 rows=9 width=8) (actual time=0.030..0.036 rows=9 loops=1)",
+		"  Buffers: shared hit=2, temp read=3",
+		"  ->  Seq Scan  (cost=0.00..1.09 rows=9 width=4) (actual time=0.000..0.000 rows=4 loops=1)",
+		"  ->  Hash  (cost=1.09..1.09 rows=9 width=4) (actual time=0.012..0.012 rows=9 loops=1)",
+		"        ->  Seq Scan  (cost=0.00..1.09 rows=9 width=4) (actual time=0.004..0.006 rows=9 loops=1)",
+		"              Buffers: shared hit=1",
+		"Execution Time: 0.052 ms",
+		"",
+	}, "\n")
+	if text != expected {
+		t.Errorf("got\n%s\nexpected\n%s", text, expected)
+	}
+}
+
+func TestExplainJSON(t *testing.T) {
+	bytes, err := ExplainJSON(explainTree(), ExplainOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(bytes)
+	for _, expected := range []string{
+		`"Node Type": "Hash Join"`,
+		`"Startup Cost": 1.20`,
+		`"Plan Rows": 9`,
+		`"Actual Startup Time": 0.030`,
+		`"Actual Loops": 1`,
+		`"Parent Relationship": "Inner"`,
+		`"Parallel Aware": false`,
+		`"Triggers": []`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %s in\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "Shared Hit Blocks") || strings.Contains(out, "Execution Time") || strings.Contains(out, "Async Capable") {
+		t.Errorf("unexpected buffers, execution time or async in\n%s", out)
+	}
+	if !strings.HasPrefix(out, "[\n  {\n    \"Plan\": {\n      \"Node Type\"") {
+		t.Errorf("unexpected structure\n%s", out)
+	}
+	if _, err := ExplainJSON(nil, ExplainOptions{}); err == nil {
+		t.Error("expected error without plan")
+	}
+}
+
+func TestExplainTextSubplans(t *testing.T) {
+	initPlan := &PlanStateWrapper{NodeTypeString: "Result", ParentRelationship: "InitPlan", TotalCost: 0.01, PlanRows: 1, NLoops: 1, NTuples: 1,
+		SetParams: []int{0, 1}}
+	member := &PlanStateWrapper{NodeTypeString: "Seq Scan", ParentRelationship: "Member", TotalCost: 1, PlanRows: 10, ParallelAware: true}
+	root := &PlanStateWrapper{NodeTypeString: "Append", TotalCost: 1.01, PlanRows: 10, Childrens: []*PlanStateWrapper{initPlan, member}}
+	text := ExplainText(root, ExplainOptions{})
+	expected := strings.Join([]string{
+		"Append  (cost=0.00..1.01 rows=10 width=0) (never executed)",
+		"  InitPlan 1 (returns $0,$1)",
+		"    ->  Result  (cost=0.00..0.01 rows=1 width=0) (actual time=0.000..0.000 rows=1 loops=1)",
+		"  ->  Parallel Seq Scan  (cost=0.00..1.00 rows=10 width=0) (never executed)",
+		"",
+	}, "\n")
+	if text != expected {
+		t.Errorf("got\n%s\nexpected\n%s", text, expected)
+	}
+}
+
+// PG14 and later print Async Capable for every node
+func TestExplainJSONAsync(t *testing.T) {
+	async, notAsync := true, false
+	scan := &PlanStateWrapper{NodeTypeString: "Foreign Scan", ParentRelationship: "Member", AsyncCapable: &async}
+	initPlan := &PlanStateWrapper{NodeTypeString: "Result", ParentRelationship: "InitPlan", AsyncCapable: &notAsync, SetParams: []int{2}}
+	root := &PlanStateWrapper{NodeTypeString: "Append", ParallelAware: true, AsyncCapable: &notAsync, Childrens: []*PlanStateWrapper{initPlan, scan}}
+	bytes, err := ExplainJSON(root, ExplainOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(bytes)
+	for _, expected := range []string{
+		"\"Node Type\": \"Append\",\n      \"Parallel Aware\": true,\n      \"Async Capable\": false,\n      \"Startup Cost\"",
+		"\"Subplan Name\": \"InitPlan 1 (returns $2)\",\n          \"Parallel Aware\": false,\n          \"Async Capable\": false,",
+		"\"Node Type\": \"Foreign Scan\",\n          \"Parent Relationship\": \"Member\",\n          \"Parallel Aware\": false,\n          \"Async Capable\": true,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %s in\n%s", expected, out)
+		}
+	}
+	if text := ExplainText(root, ExplainOptions{}); !strings.Contains(text, "  ->  Async Foreign Scan  (cost") || !strings.HasPrefix(text, "Parallel Append  (cost") {
+		t.Errorf("unexpected text\n%s", text)
+	}
+}
+
+// Gather and Gather Merge print the workers planned before those launched
+func TestExplainWorkersPlanned(t *testing.T) {
+	scan := &PlanStateWrapper{NodeTypeString: "Seq Scan", ParentRelationship: "Outer", ParallelAware: true, NLoops: 3, NTuples: 30}
+	root := &PlanStateWrapper{NodeTypeString: "Gather", NLoops: 1, NTuples: 30, WorkersPlanned: 2, WorkersLaunched: 1,
+		Childrens: []*PlanStateWrapper{scan}}
+	bytes, err := ExplainJSON(root, ExplainOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := string(bytes); !strings.Contains(out, "\"Actual Loops\": 1,\n      \"Workers Planned\": 2,\n      \"Workers Launched\": 1,") ||
+		strings.Count(out, "Workers Planned") != 1 {
+		t.Errorf("unexpected workers in\n%s", out)
+	}
+	text := ExplainText(root, ExplainOptions{})
+	expected := strings.Join([]string{
+		"Gather  (cost=0.00..0.00 rows=0 width=0) (actual time=0.000..0.000 rows=30 loops=1)",
+		"  Workers Planned: 2",
+		"  Workers Launched: 1",
+		"  ->  Parallel Seq Scan  (cost=0.00..0.00 rows=0 width=0) (actual time=0.000..0.000 rows=10 loops=3)",
+		"",
+	}, "\n")
+	if text != expected {
+		t.Errorf("got\n%s\nexpected\n%s", text, expected)
+	}
+}
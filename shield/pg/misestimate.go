@@ -0,0 +1,84 @@
+package pg
+
+import (
+	"math"
+	"time"
+)
+
+// Misestimate is a plan node whose actual rows diverge from the planner estimate
+type Misestimate struct {
+	// Path holds the node types from the root down to the node, Index the
+	// position of each node among the Plans of its parent
+	Path          []string `json:"path"`
+	Index         []int    `json:"index"`
+	NodeType      string   `json:"node_type"`
+	EstimatedRows float64  `json:"estimated_rows"`
+	ActualRows    float64  `json:"actual_rows"`
+	Loops         float64  `json:"loops"`
+	// Factor is actual rows per estimated row, below 1 for overestimates
+	Factor     float64   `json:"factor"`
+	DetectedAt time.Time `json:"detected_at"`
+	// Address is the Plan node address, it identifies the node while the
+	// query runs
+	Address uint64 `json:"-"`
+}
+
+// Underestimate reports whether the planner expected fewer rows
+func (m *Misestimate) Underestimate() bool {
+	return m.Factor > 1
+}
+
+// FindMisestimates returns the nodes whose rows per loop are off by more than
+// factor in either direction. Running nodes can only be flagged for too many
+// rows, too few rows are only known once a loop ended.
+func FindMisestimates(root *PlanStateWrapper, factor float64, now time.Time) []*Misestimate {
+	result := []*Misestimate{}
+	if factor <= 1 {
+		return result
+	}
+	root.findMisestimates(factor, now, nil, nil, &result)
+	return result
+}
+
+func (ps *PlanStateWrapper) findMisestimates(factor float64, now time.Time, path []string, index []int, result *[]*Misestimate) {
+	if ps == nil {
+		return
+	}
+	path = append(path[:len(path):len(path)], ps.NodeTypeString)
+	if m := ps.misestimate(factor); m != nil {
+		m.Path, m.Index, m.DetectedAt = path, index, now
+		*result = append(*result, m)
+	}
+	for i, child := range ps.Childrens {
+		child.findMisestimates(factor, now, path, append(index[:len(index):len(index)], i), result)
+	}
+}
+
+// misestimate compares the rows per loop, the planner never estimates below
+// one row so neither side counts below one
+func (ps *PlanStateWrapper) misestimate(factor float64) *Misestimate {
+	_, _, rows, loops := ps.totals()
+	if loops <= 0 {
+		return nil
+	}
+	actual := rows / loops
+	ratio := math.Max(actual, 1) / math.Max(ps.PlanRows, 1)
+	under := ratio > factor
+	// a running loop may still return rows
+	over := !ps.running() && ratio < 1/factor
+	if !under && !over {
+		return nil
+	}
+	address := uint64(0)
+	if ps.Plan != nil {
+		address = ps.Plan.Address
+	}
+	return &Misestimate{
+		NodeType:      ps.NodeTypeString,
+		EstimatedRows: ps.PlanRows,
+		ActualRows:    actual,
+		Loops:         loops,
+		Factor:        ratio,
+		Address:       address,
+	}
+}
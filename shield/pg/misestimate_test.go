@@ -0,0 +1,53 @@
+package pg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindMisestimates(t *testing.T) {
+	// the outer scan is still running and already returned 50 times the estimate,
+	// the index scan returned 1 row per loop instead of 100
+	index := &PlanStateWrapper{NodeTypeString: "Index Scan", Plan: &NodeStore{Address: 0x300}, PlanRows: 100, NTuples: 40, NLoops: 40}
+	outer := &PlanStateWrapper{NodeTypeString: "Seq Scan", Plan: &NodeStore{Address: 0x200}, PlanRows: 10, Running: true, TupleCount: 500}
+	loop := &PlanStateWrapper{NodeTypeString: "Nested Loop", Plan: &NodeStore{Address: 0x100}, PlanRows: 1000, Running: true, TupleCount: 40,
+		Childrens: []*PlanStateWrapper{outer, index}}
+	now := time.Now()
+	found := FindMisestimates(loop, 10, now)
+	if len(found) != 2 {
+		t.Fatalf("found %d misestimates", len(found))
+	}
+	under, over := found[0], found[1]
+	if !reflect.DeepEqual(under.Path, []string{"Nested Loop", "Seq Scan"}) || !reflect.DeepEqual(under.Index, []int{0}) ||
+		!under.Underestimate() || under.Factor != 50 || under.Address != 0x200 || !under.DetectedAt.Equal(now) {
+		t.Errorf("unexpected underestimate %+v", under)
+	}
+	if !reflect.DeepEqual(over.Path, []string{"Nested Loop", "Index Scan"}) || !reflect.DeepEqual(over.Index, []int{1}) ||
+		over.Underestimate() || over.ActualRows != 1 || over.Loops != 40 {
+		t.Errorf("unexpected overestimate %+v", over)
+	}
+	if len(FindMisestimates(loop, 100, now)) != 0 {
+		t.Error("misestimates within factor")
+	}
+	if len(FindMisestimates(loop, 0, now)) != 0 {
+		t.Error("detection not disabled")
+	}
+}
+
+func TestFindMisestimatesRunning(t *testing.T) {
+	// too few rows so far, the loop may still return more
+	scan := &PlanStateWrapper{NodeTypeString: "Seq Scan", PlanRows: 1000, Running: true, TupleCount: 1}
+	if len(FindMisestimates(scan, 10, time.Now())) != 0 {
+		t.Error("running node flagged as overestimate")
+	}
+	// never executed and empty results are not misestimates
+	scan = &PlanStateWrapper{NodeTypeString: "Seq Scan", PlanRows: 1}
+	if len(FindMisestimates(scan, 10, time.Now())) != 0 {
+		t.Error("node without loops flagged")
+	}
+	scan.NLoops = 1
+	if len(FindMisestimates(scan, 10, time.Now())) != 0 {
+		t.Error("empty result below one row flagged")
+	}
+}
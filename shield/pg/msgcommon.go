@@ -11,10 +11,26 @@ func ParsePlanString(p string) map[string]string {
 	fields := strings.Split(p, ",")
 	for _, field := range fields {
 		keyval := strings.SplitN(field, ":", 2)
-		result[keyval[0]] = keyval[1]
+		if len(keyval) != 2 {
+			continue
+		}
+		result[strings.TrimSpace(keyval[0])] = strings.TrimSpace(keyval[1])
 	}
 	return result
 }
+
+// parseHexFloat64 reads a double the probes print as its bits in hex, with
+// or without the 0x prefix
+func parseHexFloat64(val string) (float64, error) {
+	return ConvertHexToFloat64(strings.TrimPrefix(val, "0x"))
+}
+
+// parseFlag reads a bool the probes print as an int8 in hex
+func parseFlag(val string) (bool, error) {
+	n, err := strconv.ParseUint(val, 0, 8)
+	return n != 0, err
+}
+
 func ConvertHexToFloat64(val string) (float64, error) {
 	n, err := strconv.ParseUint(val, 16, 64)
 	if err != nil {
@@ -0,0 +1,140 @@
+package pg
+
+import (
+	"sort"
+)
+
+// WorkerInstrumentation is the instrumentation of a plan node in one
+// parallel worker
+type WorkerInstrumentation struct {
+	WorkerNumber int     `json:"Worker Number"`
+	TupleCount   float64 `json:"Tuple Count"`
+	Running      bool    `json:"Running"`
+	Startup      float64 `json:"Startup Time,omitempty"`
+	TotalTime    float64 `json:"Total Time,omitempty"`
+	NTuples      float64 `json:"Actual Rows,omitempty"`
+	NLoops       float64 `json:"Actual Loops,omitempty"`
+	// Finished is set once the worker ended. The Gather adds the counters of
+	// its workers to the leader when it shuts them down, so the counters of
+	// finished workers are not added again.
+	Finished bool `json:"Finished"`
+}
+
+// actuals returns the per loop averages like PlanStateWrapper.actuals
+func (w *WorkerInstrumentation) actuals() (startup float64, total float64, rows float64, loops float64) {
+	startup, total, rows, loops = w.counters()
+	if loops <= 0 {
+		return 0, 0, 0, 0
+	}
+	return 1000 * startup / loops, 1000 * total / loops, rows / loops, loops
+}
+
+// counters returns the sums of the worker, a running loop counts
+func (w *WorkerInstrumentation) counters() (startup float64, total float64, rows float64, loops float64) {
+	startup, total, rows, loops = w.Startup, w.TotalTime, w.NTuples, w.NLoops
+	if w.Running {
+		rows += w.TupleCount
+		loops++
+	}
+	return startup, total, rows, loops
+}
+
+// totals returns the sums EXPLAIN ANALYZE prints divided by the loops: the
+// leader with its running loop and the workers the leader does not hold yet
+func (ps *PlanStateWrapper) totals() (startup float64, total float64, rows float64, loops float64) {
+	startup, total, rows, loops = ps.Startup, ps.TotalTime, ps.NTuples, ps.NLoops
+	if ps.Running {
+		rows += ps.TupleCount
+		loops++
+	}
+	for _, w := range ps.Workers {
+		if w.Finished {
+			continue
+		}
+		s, t, r, l := w.counters()
+		startup, total, rows, loops = startup+s, total+t, rows+r, loops+l
+	}
+	return startup, total, rows, loops
+}
+
+func (ps *PlanStateWrapper) isGather() bool {
+	return ps.NodeTypeString == "Gather" || ps.NodeTypeString == "Gather Merge"
+}
+
+// running reports whether the leader or a worker is in a loop of the node
+func (ps *PlanStateWrapper) running() bool {
+	if ps.Running {
+		return true
+	}
+	for _, w := range ps.Workers {
+		if w.Running && !w.Finished {
+			return true
+		}
+	}
+	return false
+}
+
+// setWorker replaces the counters of the worker, Workers stays sorted by
+// worker number
+func (ps *PlanStateWrapper) setWorker(worker *WorkerInstrumentation) {
+	for i, w := range ps.Workers {
+		if w.WorkerNumber == worker.WorkerNumber {
+			ps.Workers[i] = worker
+			return
+		}
+	}
+	ps.Workers = append(ps.Workers, worker)
+	sort.Slice(ps.Workers, func(i, j int) bool { return ps.Workers[i].WorkerNumber < ps.Workers[j].WorkerNumber })
+}
+
+// WorkerSample holds the counters of the plan of one parallel worker by plan
+// node id
+type WorkerSample struct {
+	WorkerNumber int
+	// RootID is the plan node id the worker plan starts at, the node below
+	// the Gather
+	RootID int
+	Nodes  map[int]*WorkerInstrumentation
+}
+
+// WorkerSample copies the counters of the tree of a parallel worker
+func (t *PlanTree) WorkerSample(number int, finished bool) *WorkerSample {
+	if t.Root == nil || t.Root.Plan.planNodeID < 0 {
+		return nil
+	}
+	sample := &WorkerSample{WorkerNumber: number, RootID: t.Root.Plan.planNodeID, Nodes: map[int]*WorkerInstrumentation{}}
+	for id, node := range t.ids {
+		sample.Nodes[id] = &WorkerInstrumentation{
+			WorkerNumber: number,
+			TupleCount:   node.TupleCount,
+			Running:      node.Running,
+			Startup:      node.Startup,
+			TotalTime:    node.TotalTime,
+			NTuples:      node.NTuples,
+			NLoops:       node.NLoops,
+			Finished:     finished,
+		}
+	}
+	return sample
+}
+
+// MergeWorker adds the counters of a worker to the nodes of the leader plan
+// with the same plan node id and counts the worker as launched by the Gather
+// above it. It reports false when no node matched.
+func (t *PlanTree) MergeWorker(sample *WorkerSample) bool {
+	matched := false
+	for id, counters := range sample.Nodes {
+		if node := t.FindNodeByID(id); node != nil {
+			node.setWorker(counters)
+			matched = true
+		}
+	}
+	top := t.FindNodeByID(sample.RootID)
+	if top == nil {
+		return matched
+	}
+	if gather := t.Parent(top); gather != nil && gather.isGather() {
+		gather.WorkersLaunched = len(top.Workers)
+	}
+	return matched
+}
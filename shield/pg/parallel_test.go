@@ -0,0 +1,66 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+)
+
+// gatherPlan builds the leader plan of a Gather over a Seq Scan and the plan
+// of one worker running the Seq Scan
+func gatherPlan() (*PlanTree, *PlanTree) {
+	leader := NewPlanTree()
+	gather := planNode("plantype:1,plan:0x10,leftplan:0x20,rightplan:0x0,root:0x10,plan_node_id:0")
+	gather.NodeTypeString = "Gather"
+	leader.Insert(gather)
+	scan := planNode("plantype:2,plan:0x20,leftplan:0x0,rightplan:0x0,root:0x10,plan_node_id:1")
+	scan.NodeTypeString, scan.PlanRows, scan.NLoops, scan.NTuples = "Seq Scan", 100, 1, 80
+	leader.Insert(scan)
+
+	worker := NewPlanTree()
+	wscan := planNode("plantype:2,plan:0x90,leftplan:0x0,rightplan:0x0,root:0x90,plan_node_id:1")
+	wscan.Running, wscan.TupleCount = true, 60
+	worker.Insert(wscan)
+	return leader, worker
+}
+
+func TestMergeWorker(t *testing.T) {
+	leader, worker := gatherPlan()
+	if !leader.MergeWorker(worker.WorkerSample(0, false)) {
+		t.Fatal("worker matched no node")
+	}
+	scan := leader.FindNodeByID(1)
+	if len(scan.Workers) != 1 || scan.Workers[0].TupleCount != 60 {
+		t.Fatalf("workers %+v", scan.Workers)
+	}
+	if leader.Root.WorkersLaunched != 1 {
+		t.Errorf("workers launched %d", leader.Root.WorkersLaunched)
+	}
+	if _, _, rows, loops := scan.totals(); rows != 140 || loops != 2 {
+		t.Errorf("totals %f rows %f loops", rows, loops)
+	}
+	// a second sample replaces the counters of the worker
+	worker.Root.Running, worker.Root.NLoops, worker.Root.NTuples = false, 1, 90
+	leader.MergeWorker(worker.WorkerSample(0, true))
+	if len(scan.Workers) != 1 || scan.Workers[0].NTuples != 90 {
+		t.Fatalf("workers %+v", scan.Workers)
+	}
+	// the leader holds the counters of finished workers
+	if _, _, rows, loops := scan.totals(); rows != 80 || loops != 1 {
+		t.Errorf("totals %f rows %f loops", rows, loops)
+	}
+}
+
+func TestExplainWorkers(t *testing.T) {
+	leader, worker := gatherPlan()
+	leader.MergeWorker(worker.WorkerSample(1, false))
+	text := ExplainText(leader.Root, ExplainOptions{})
+	for _, line := range []string{
+		"  Workers Launched: 1\n",
+		"  ->  Seq Scan  (cost=0.00..0.00 rows=100 width=0) (actual time=0.000..0.000 rows=70 loops=2)\n",
+		"        Worker 1:  actual time=0.000..0.000 rows=60 loops=1\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("missing %q in\n%s", line, text)
+		}
+	}
+}
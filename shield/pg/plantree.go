@@ -0,0 +1,135 @@
+package pg
+
+// PlanTree assembles the plan state tree from GenerateNode messages in any
+// order. Nodes are indexed by address, a node whose parent did not arrive yet
+// waits until it does.
+type PlanTree struct {
+	// Root is the desc->planstate node, nil until it arrived
+	Root     *PlanStateWrapper
+	rootAddr uint64
+	nodes    map[uint64]*PlanStateWrapper
+	// ids indexes the nodes by plan node id
+	ids map[int]*PlanStateWrapper
+	// links maps the address of an expected child to its parent and
+	// relationship, known from the parent or the child itself
+	links map[uint64]planLink
+	// waiting maps a parent address not seen yet to the children naming it
+	waiting map[uint64][]uint64
+	// attached holds the nodes below their parent
+	attached map[uint64]bool
+}
+
+type planLink struct {
+	parent       uint64
+	relationship string
+}
+
+// NewPlanTree returns an empty tree
+func NewPlanTree() *PlanTree {
+	return &PlanTree{
+		nodes:    map[uint64]*PlanStateWrapper{},
+		ids:      map[int]*PlanStateWrapper{},
+		links:    map[uint64]planLink{},
+		waiting:  map[uint64][]uint64{},
+		attached: map[uint64]bool{},
+	}
+}
+
+// Insert adds node to the tree and attaches the nodes waiting for it, it
+// reports false for nodes without address and nodes already in the tree.
+// Nodes of agents that do not send the root address take the first node as
+// root.
+func (t *PlanTree) Insert(node *PlanStateWrapper) bool {
+	if node.Plan == nil || node.Plan.Address == 0 {
+		return false
+	}
+	addr := node.Plan.Address
+	if _, ok := t.nodes[addr]; ok {
+		return false
+	}
+	t.nodes[addr] = node
+	if node.Plan.planNodeID >= 0 {
+		t.ids[node.Plan.planNodeID] = node
+	}
+	if t.rootAddr == 0 {
+		t.rootAddr = node.Plan.rootAddr
+		if t.rootAddr == 0 && t.Root == nil {
+			t.rootAddr = addr
+		}
+	}
+	if addr == t.rootAddr {
+		t.Root = node
+	}
+
+	if node.Plan.parentAddr != 0 {
+		t.link(addr, node.Plan.parentAddr, node.Plan.relationship)
+	} else if link, ok := t.links[addr]; ok {
+		t.attach(addr, link)
+	}
+	t.link(node.Plan.leftAddr, addr, "Outer")
+	t.link(node.Plan.rightAddr, addr, "Inner")
+	for _, child := range t.waiting[addr] {
+		t.attach(child, t.links[child])
+	}
+	delete(t.waiting, addr)
+	return true
+}
+
+// link records the parent of child and attaches child when both arrived
+func (t *PlanTree) link(child uint64, parent uint64, relationship string) {
+	if child == 0 {
+		return
+	}
+	link := planLink{parent, relationship}
+	t.links[child] = link
+	if _, ok := t.nodes[parent]; !ok {
+		t.waiting[parent] = append(t.waiting[parent], child)
+		return
+	}
+	t.attach(child, link)
+}
+
+func (t *PlanTree) attach(child uint64, link planLink) {
+	node, ok := t.nodes[child]
+	parent, parentOk := t.nodes[link.parent]
+	if !ok || !parentOk || t.attached[child] {
+		return
+	}
+	t.attached[child] = true
+	parent.addChild(node, link.relationship)
+}
+
+// FindNodeByAddr returns the node with the address, waiting nodes included
+func (t *PlanTree) FindNodeByAddr(addr uint64) *PlanStateWrapper {
+	return t.nodes[addr]
+}
+
+// Len returns the number of nodes, waiting nodes included
+func (t *PlanTree) Len() int {
+	return len(t.nodes)
+}
+
+// FindNodeByID returns the node with the plan node id
+func (t *PlanTree) FindNodeByID(id int) *PlanStateWrapper {
+	return t.ids[id]
+}
+
+// Parent returns the node node is attached to, nil for the root and waiting
+// nodes
+func (t *PlanTree) Parent(node *PlanStateWrapper) *PlanStateWrapper {
+	if node.Plan == nil || !t.attached[node.Plan.Address] {
+		return nil
+	}
+	return t.nodes[t.links[node.Plan.Address].parent]
+}
+
+// Pending returns the number of nodes not connected to the root yet
+func (t *PlanTree) Pending() int {
+	pending := 0
+	for addr := range t.nodes {
+		if addr != t.rootAddr && !t.attached[addr] {
+			pending++
+		}
+	}
+	return pending
+}
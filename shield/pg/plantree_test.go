@@ -0,0 +1,104 @@
+package pg
+
+import (
+	"testing"
+)
+
+func planNode(msg string) *PlanStateWrapper {
+	ps := new(PlanStateWrapper)
+	ps.InitPlanStateWrapperFromExecInitPlan(msg)
+	return ps
+}
+
+// appendPlan is an Append with an init plan and two members, the first one
+// has a sub plan, in the order the probe walks it
+var appendPlan = []string{
+	"plantype:1,plan:0x10,leftplan:0x0,rightplan:0x0,root:0x10,seq:0",
+	"plantype:3,plan:0x40,leftplan:0x0,rightplan:0x0,parent:0x10,relationship:InitPlan,root:0x10,seq:1",
+	"plantype:2,plan:0x20,leftplan:0x50,rightplan:0x0,parent:0x10,relationship:Member,root:0x10,seq:2",
+	"plantype:2,plan:0x50,leftplan:0x0,rightplan:0x0,root:0x10,seq:3",
+	"plantype:3,plan:0x60,leftplan:0x0,rightplan:0x0,parent:0x20,relationship:SubPlan,root:0x10,seq:4",
+	"plantype:2,plan:0x30,leftplan:0x0,rightplan:0x0,parent:0x10,relationship:Member,root:0x10,seq:5",
+}
+
+func checkAppendPlan(t *testing.T, tree *PlanTree) {
+	root := tree.Root
+	if root == nil || root.Plan.Address != 0x10 {
+		t.Fatalf("root %+v", root)
+	}
+	if len(root.Childrens) != 3 {
+		t.Fatalf("root has %d children", len(root.Childrens))
+	}
+	for i, expected := range []uint64{0x40, 0x20, 0x30} {
+		if root.Childrens[i].Plan.Address != expected {
+			t.Errorf("child %d is %#x, expected %#x", i, root.Childrens[i].Plan.Address, expected)
+		}
+	}
+	for i, expected := range []string{"InitPlan", "Member", "Member"} {
+		if root.Childrens[i].ParentRelationship != expected {
+			t.Errorf("child %d is %s, expected %s", i, root.Childrens[i].ParentRelationship, expected)
+		}
+	}
+	first := root.Childrens[1]
+	if len(first.Childrens) != 2 || first.Childrens[0].ParentRelationship != "Outer" || first.Childrens[1].ParentRelationship != "SubPlan" {
+		t.Errorf("first member children %+v", first.Childrens)
+	}
+	if tree.Pending() != 0 {
+		t.Errorf("%d nodes pending", tree.Pending())
+	}
+}
+
+func TestPlanTreeInOrder(t *testing.T) {
+	tree := NewPlanTree()
+	for _, msg := range appendPlan {
+		if !tree.Insert(planNode(msg)) {
+			t.Fatalf("failed to insert %s", msg)
+		}
+	}
+	checkAppendPlan(t, tree)
+	if tree.Insert(planNode(appendPlan[2])) {
+		t.Error("node inserted twice")
+	}
+}
+
+func TestPlanTreeOutOfOrder(t *testing.T) {
+	tree := NewPlanTree()
+	for i := len(appendPlan) - 1; i >= 0; i-- {
+		tree.Insert(planNode(appendPlan[i]))
+		if i > 0 && tree.Root != nil {
+			t.Fatal("root set before it arrived")
+		}
+	}
+	checkAppendPlan(t, tree)
+	if tree.FindNodeByAddr(0x60) == nil || tree.FindNodeByAddr(0x99) != nil {
+		t.Error("address lookup mismatch")
+	}
+
+	// members first, then the root, then the rest
+	tree = NewPlanTree()
+	for _, i := range []int{5, 3, 2, 0, 4, 1} {
+		tree.Insert(planNode(appendPlan[i]))
+	}
+	checkAppendPlan(t, tree)
+}
+
+func TestPlanTreeOrphan(t *testing.T) {
+	tree := NewPlanTree()
+	tree.Insert(planNode(appendPlan[0]))
+	tree.Insert(planNode(appendPlan[4]))
+	if tree.Pending() != 1 || tree.FindNodeByAddr(0x60) == nil {
+		t.Errorf("sub plan not waiting, %d pending", tree.Pending())
+	}
+	if len(tree.Root.Childrens) != 0 {
+		t.Error("orphan attached to the root")
+	}
+}
+
+func TestPlanTreeWithoutRoot(t *testing.T) {
+	tree := NewPlanTree()
+	tree.Insert(planNode("plantype:1,plan:0x10,leftplan:0x20,rightplan:0x0"))
+	tree.Insert(planNode("plantype:2,plan:0x20,leftplan:0x0,rightplan:0x0"))
+	if tree.Root == nil || tree.Root.Plan.Address != 0x10 || len(tree.Root.Childrens) != 1 {
+		t.Errorf("root %+v", tree.Root)
+	}
+}
@@ -0,0 +1,117 @@
+package pg
+
+import (
+	"math"
+	"time"
+)
+
+// QueryProgress is the estimated completion of a running query
+type QueryProgress struct {
+	// Percent is the cost weighted progress of all plan nodes
+	Percent        float64 `json:"percent"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// RemainingSeconds and ETA are unknown until some progress was made
+	RemainingSeconds *float64   `json:"remaining_seconds,omitempty"`
+	ETA              *time.Time `json:"eta,omitempty"`
+}
+
+// blockingNodes read all their input before they return the first row
+var blockingNodes = map[string]bool{
+	"Sort":             true,
+	"Incremental Sort": true,
+	"Hash":             true,
+	"Aggregate":        true,
+	"Materialize":      true,
+	"WindowAgg":        true,
+	"SetOp":            true,
+}
+
+// running nodes never report done, the last percent waits for the loop to end
+const maxRunningProgress = 0.99
+
+// EstimateProgress sets the Progress of every node and returns the progress of
+// the whole query, started is when the executor started
+func EstimateProgress(root *PlanStateWrapper, started time.Time, now time.Time) *QueryProgress {
+	result := &QueryProgress{}
+	if !started.IsZero() && now.After(started) {
+		result.ElapsedSeconds = now.Sub(started).Seconds()
+	}
+	if root == nil {
+		return result
+	}
+	root.estimateProgress(-1)
+	done, total := root.weightedProgress()
+	if total > 0 {
+		result.Percent = 100 * done / total
+	} else {
+		result.Percent = 100 * root.Progress
+	}
+	if result.Percent > 0 && result.ElapsedSeconds > 0 {
+		remaining := result.ElapsedSeconds * (100 - result.Percent) / result.Percent
+		eta := now.Add(time.Duration(remaining * float64(time.Second)))
+		result.RemainingSeconds, result.ETA = &remaining, &eta
+	}
+	return result
+}
+
+// estimateProgress sets the progress of the subtree. A subtree rescanned by a
+// Nested Loop advances with the outer side, driver is that progress or
+// negative outside of rescanned subtrees.
+func (ps *PlanStateWrapper) estimateProgress(driver float64) {
+	for i, child := range ps.Childrens {
+		childDriver := driver
+		if childDriver < 0 && i == 1 && ps.NodeTypeString == "Nested Loop" {
+			childDriver = ps.Childrens[0].Progress
+		}
+		child.estimateProgress(childDriver)
+	}
+	if driver >= 0 {
+		ps.Progress = driver
+		return
+	}
+	ps.Progress = ps.ownProgress()
+}
+
+// ownProgress compares the rows returned so far with the estimate, blocking
+// nodes spend the first half reading their input. The estimate of a node run
+// by parallel workers is per process.
+func (ps *PlanStateWrapper) ownProgress() float64 {
+	_, _, rows, loops := ps.totals()
+	rows /= float64(1 + len(ps.Workers))
+	running := ps.running()
+	started := running || loops > 0
+	blocking := blockingNodes[ps.NodeTypeString]
+	switch {
+	case !started && blocking && len(ps.Childrens) > 0:
+		return 0.5 * ps.Childrens[0].Progress
+	case !started:
+		return 0
+	case !running:
+		// the loop ended
+		return 1
+	}
+	output := maxRunningProgress
+	if ps.PlanRows > 0 {
+		output = math.Min(rows/ps.PlanRows, maxRunningProgress)
+	}
+	if blocking {
+		return 0.5 + 0.5*output
+	}
+	return output
+}
+
+// weightedProgress sums the progress of the nodes weighted with the cost of
+// each node without its children
+func (ps *PlanStateWrapper) weightedProgress() (done float64, total float64) {
+	own := ps.TotalCost
+	for _, child := range ps.Childrens {
+		own -= child.TotalCost
+		childDone, childTotal := child.weightedProgress()
+		done += childDone
+		total += childTotal
+	}
+	if own < 0 {
+		own = 0
+	}
+	return done + own*ps.Progress, total + own
+}
@@ -0,0 +1,66 @@
+package pg
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEstimateProgressScan(t *testing.T) {
+	scan := &PlanStateWrapper{NodeTypeString: "Seq Scan", TotalCost: 100, PlanRows: 1000, Running: true, TupleCount: 250}
+	start := time.Now()
+	progress := EstimateProgress(scan, start, start.Add(10*time.Second))
+	if scan.Progress != 0.25 || progress.Percent != 25 {
+		t.Fatalf("progress %f %f", scan.Progress, progress.Percent)
+	}
+	if progress.RemainingSeconds == nil || math.Abs(*progress.RemainingSeconds-30) > 1e-6 {
+		t.Fatalf("remaining %v", progress.RemainingSeconds)
+	}
+	if !progress.ETA.Equal(start.Add(40 * time.Second)) {
+		t.Errorf("eta %s", progress.ETA)
+	}
+	// more rows than estimated never reach 100% while running
+	scan.TupleCount = 5000
+	if EstimateProgress(scan, start, start.Add(time.Second)).Percent != 100*maxRunningProgress {
+		t.Errorf("running node reported done")
+	}
+	scan.Running, scan.NTuples, scan.NLoops = false, 5000, 1
+	if EstimateProgress(scan, start, start.Add(time.Second)).Percent != 100 {
+		t.Errorf("finished node not done")
+	}
+}
+
+func TestEstimateProgressBlocking(t *testing.T) {
+	scan := &PlanStateWrapper{NodeTypeString: "Seq Scan", TotalCost: 100, PlanRows: 1000, Running: true, TupleCount: 500}
+	sort := &PlanStateWrapper{NodeTypeString: "Sort", TotalCost: 300, PlanRows: 1000, Childrens: []*PlanStateWrapper{scan}}
+	progress := EstimateProgress(sort, time.Time{}, time.Now())
+	// the sort is reading its input, it is half way through that phase
+	if scan.Progress != 0.5 || sort.Progress != 0.25 {
+		t.Fatalf("progress scan %f sort %f", scan.Progress, sort.Progress)
+	}
+	if progress.Percent != 100*(100*0.5+200*0.25)/300 {
+		t.Errorf("weighted percent %f", progress.Percent)
+	}
+	if progress.RemainingSeconds != nil {
+		t.Error("remaining time without start time")
+	}
+	// the input is read and half of the sorted rows are returned
+	scan.Running, scan.NTuples, scan.NLoops = false, 1000, 1
+	sort.Running, sort.TupleCount = true, 500
+	EstimateProgress(sort, time.Time{}, time.Now())
+	if sort.Progress != 0.75 {
+		t.Errorf("sort output progress %f", sort.Progress)
+	}
+}
+
+func TestEstimateProgressNestLoop(t *testing.T) {
+	index := &PlanStateWrapper{NodeTypeString: "Index Scan", TotalCost: 1, PlanRows: 1, NTuples: 40, NLoops: 40}
+	outer := &PlanStateWrapper{NodeTypeString: "Seq Scan", TotalCost: 10, PlanRows: 100, Running: true, TupleCount: 40}
+	loop := &PlanStateWrapper{NodeTypeString: "Nested Loop", TotalCost: 110, PlanRows: 100, Running: true, TupleCount: 40,
+		Childrens: []*PlanStateWrapper{outer, index}}
+	EstimateProgress(loop, time.Time{}, time.Now())
+	// the inner side is rescanned for every outer row, it is as far as the outer side
+	if index.Progress != outer.Progress || outer.Progress != 0.4 {
+		t.Errorf("inner %f outer %f", index.Progress, outer.Progress)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"postTap/config"
+	"postTap/pgprofile"
+	"postTap/shield/pg"
+)
+
+func TestSamplerBuffers(t *testing.T) {
+	profile, _ := pgprofile.GetProfile("pg10")
+	qi := &QueryInfo{instruConfig: map[string]bool{"base": true, "accumulated": false, "buffer": false}, profile: profile, conf: config.Default()}
+	fields := func() string {
+		names := []string{}
+		for _, f := range qi.Sampler().Fields {
+			names = append(names, f.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	if names := fields(); names != "plannode,running,tuplecount" {
+		t.Errorf("sampled %s", names)
+	}
+	qi.instruConfig["buffer"] = true
+	if names := fields(); !strings.Contains(names, "shared_blks_hit") {
+		t.Errorf("buffers not read: %s", names)
+	}
+}
+
+func TestUpdateProgress(t *testing.T) {
+	begin := time.Now()
+	qi := &QueryInfo{statusCode: start, StartTime: begin,
+		PlanStateRoot: &pg.PlanStateWrapper{NodeTypeString: "Seq Scan", TotalCost: 10, PlanRows: 100, Running: true, TupleCount: 50}}
+	qi.UpdateProgress(begin.Add(time.Second))
+	if qi.Progress.Percent != 50 || qi.Progress.RemainingSeconds == nil {
+		t.Fatalf("progress %+v", qi.Progress)
+	}
+	qi.statusCode = finish
+	qi.UpdateProgress(begin.Add(2 * time.Second))
+	if qi.Progress.Percent != 100 || qi.Progress.ETA != nil {
+		t.Errorf("finished query progress %+v", qi.Progress)
+	}
+	if qi.Summary().Progress != qi.Progress {
+		t.Error("summary lacks progress")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "fmt"
+
+// SubscribeMsg is sent by websocket clients to choose what they receive, e.g.
+// {"action": "subscribe", "pid": 1234, "host": "seg1"} or
+// {"action": "unsubscribe", "db": "postgres"}
+type SubscribeMsg struct {
+	Action string `json:"action"`
+	All    bool   `json:"all,omitempty"`
+	Pid    int    `json:"pid,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Db     string `json:"db,omitempty"`
+	User   string `json:"user,omitempty"`
+}
+
+// Subscription decides which queries a websocket client receives.
+// A pid subscribed without host matches that pid on every host, a pid
+// unsubscribed without host is removed for every host.
+type Subscription struct {
+	All     bool
+	Queries map[QueryKey]bool
+	Dbnames map[string]bool
+	Users   map[string]bool
+}
+
+func NewSubscription() *Subscription {
+	return &Subscription{Queries: map[QueryKey]bool{}, Dbnames: map[string]bool{}, Users: map[string]bool{}}
+}
+
+// Match reports whether the client wants the message
+func (sub *Subscription) Match(msg *HubMessage) bool {
+	return sub.All ||
+		sub.Queries[msg.Key] || sub.Queries[QueryKey{Pid: msg.Key.Pid}] ||
+		(msg.Dbname != "" && sub.Dbnames[msg.Dbname]) ||
+		(msg.Username != "" && sub.Users[msg.Username])
+}
+
+// Apply adds or removes the filters named in msg
+func (sub *Subscription) Apply(msg *SubscribeMsg) error {
+	var add bool
+	switch msg.Action {
+	case "subscribe":
+		add = true
+	case "unsubscribe":
+		add = false
+	default:
+		return fmt.Errorf("Unsupported subscription action: %s", msg.Action)
+	}
+	if msg.All {
+		sub.All = add
+	}
+	if msg.Pid != 0 {
+		key := QueryKey{msg.Host, msg.Pid}
+		switch {
+		case add:
+			sub.Queries[key] = true
+		case msg.Host == "":
+			for subscribed := range sub.Queries {
+				if subscribed.Pid == msg.Pid {
+					delete(sub.Queries, subscribed)
+				}
+			}
+		default:
+			delete(sub.Queries, key)
+		}
+	}
+	if msg.Db != "" {
+		if add {
+			sub.Dbnames[msg.Db] = true
+		} else {
+			delete(sub.Dbnames, msg.Db)
+		}
+	}
+	if msg.User != "" {
+		if add {
+			sub.Users[msg.User] = true
+		} else {
+			delete(sub.Users, msg.User)
+		}
+	}
+	return nil
+}